@@ -0,0 +1,113 @@
+package dusts_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("binary cache", func() {
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		sourceDir, err = ioutil.TempDir("", "dusts-source-")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(sourceDir, "go.mod"), []byte("module example.com/bbs\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(sourceDir)).To(Succeed())
+	})
+
+	type keyInputs struct {
+		packagePath string
+		args        []string
+		env         map[string]string
+	}
+
+	key := func(inputs keyInputs) string {
+		getenv := func(name string) string { return inputs.env[name] }
+		path, binary, err := cachedBinaryPath("/binaries", sourceDir, inputs.packagePath, inputs.args, getenv)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join("/binaries", binary.Key, "bbs")))
+		return binary.Key
+	}
+
+	base := func() keyInputs {
+		return keyInputs{
+			packagePath: "code.cloudfoundry.org/bbs/cmd/bbs",
+			args:        []string{"-race"},
+			env:         map[string]string{"GOOS": "linux", "CGO_ENABLED": "1"},
+		}
+	}
+
+	DescribeTable("the cache key",
+		func(change func(*keyInputs), changesKey bool) {
+			changed := base()
+			change(&changed)
+			if changesKey {
+				Expect(key(changed)).NotTo(Equal(key(base())))
+			} else {
+				Expect(key(changed)).To(Equal(key(base())))
+			}
+		},
+		Entry("is stable for the same inputs", func(*keyInputs) {}, false),
+		Entry("changes with the build args", func(i *keyInputs) { i.args = nil }, true),
+		Entry("changes with a build env var", func(i *keyInputs) { i.env["GOOS"] = "darwin" }, true),
+		Entry("changes when a build env var is set", func(i *keyInputs) { i.env["GOFLAGS"] = "-mod=vendor" }, true),
+		Entry("ignores other env vars", func(i *keyInputs) { i.env["HOME"] = "/somewhere" }, false),
+		Entry("changes with the package, with the same binary name", func(i *keyInputs) {
+			i.packagePath = "code.cloudfoundry.org/other/cmd/bbs"
+		}, true),
+	)
+
+	It("changes the key when the source changes", func() {
+		before := key(base())
+		Expect(ioutil.WriteFile(filepath.Join(sourceDir, "go.sum"), []byte("example.com/dep v1.0.0 h1:abc=\n"), 0644)).To(Succeed())
+		Expect(key(base())).NotTo(Equal(before))
+	})
+
+	Describe("sourceRevision", func() {
+		gitIn := func(dir string, args ...string) {
+			cmd := exec.Command("git", append([]string{"-c", "user.name=dusts", "-c", "user.email=dusts@example.com"}, args...)...)
+			cmd.Dir = dir
+			output, err := cmd.CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(output))
+		}
+
+		It("hashes go.mod and go.sum outside of a git checkout", func() {
+			revision, err := sourceRevision(sourceDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(revision).To(MatchRegexp(`^go\.sum:[0-9a-f]{16}$`))
+		})
+
+		It("uses HEAD of a git checkout and marks uncommitted changes", func() {
+			gitIn(sourceDir, "init", "-q")
+			gitIn(sourceDir, "add", "go.mod")
+			gitIn(sourceDir, "commit", "-q", "-m", "initial")
+			head, err := git(sourceDir, "rev-parse", "HEAD")
+			Expect(err).NotTo(HaveOccurred())
+
+			revision, err := sourceRevision(sourceDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(revision).To(Equal(head))
+
+			Expect(ioutil.WriteFile(filepath.Join(sourceDir, "go.mod"), []byte("module example.com/changed\n"), 0644)).To(Succeed())
+			revision, err = sourceRevision(sourceDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(revision).To(MatchRegexp(`^` + head + `\+[0-9a-f]{12}$`))
+		})
+
+		It("fails for a directory that is neither a git checkout nor a go module", func() {
+			Expect(os.Remove(filepath.Join(sourceDir, "go.mod"))).To(Succeed())
+			_, err := sourceRevision(sourceDir)
+			Expect(err).To(MatchError(ContainSubstring("it is neither a git checkout nor a go module")))
+		})
+	})
+})
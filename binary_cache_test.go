@@ -0,0 +1,169 @@
+package dusts_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEnvVars are the env vars that change the output of go build.
+var cacheEnvVars = []string{"CGO_ENABLED", "GO111MODULE", "GOFLAGS", "GOOS", "GOARCH"}
+
+// builtBinary is an entry of the manifest.json kept in every binaries
+// directory, describing how each cached binary was built.
+type builtBinary struct {
+	Name      string    `json:"name"`
+	Package   string    `json:"package"`
+	Source    string    `json:"source"`
+	Revision  string    `json:"revision"`
+	Args      []string  `json:"args"`
+	Env       []string  `json:"env"`
+	GoVersion string    `json:"go_version"`
+	Key       string    `json:"key"`
+	Path      string    `json:"path"`
+	BuiltAt   time.Time `json:"built_at"`
+}
+
+var (
+	manifestMu sync.Mutex
+
+	goVersionOnce sync.Once
+	goVersion     string
+)
+
+// cachedBinaryPath returns where the binary of packagePath built from
+// sourceDir with args and the env given by getenv is cached. Binaries are keyed on
+// the source revision, so switching branches picks up a different binary
+// and switching back reuses the old one.
+func cachedBinaryPath(binariesPath, sourceDir, packagePath string, args []string, getenv func(string) string) (string, builtBinary, error) {
+	revision, err := sourceRevision(sourceDir)
+	if err != nil {
+		return "", builtBinary{}, err
+	}
+
+	env := []string{}
+	for _, name := range cacheEnvVars {
+		env = append(env, fmt.Sprintf("%s=%s", name, getenv(name)))
+	}
+
+	binary := builtBinary{
+		Name:      filepath.Base(packagePath),
+		Package:   packagePath,
+		Source:    sourceDir,
+		Revision:  revision,
+		Args:      args,
+		Env:       env,
+		GoVersion: currentGoVersion(),
+	}
+
+	parts := []string{binary.Package, binary.Revision, binary.GoVersion}
+	parts = append(parts, args...)
+	parts = append(parts, env...)
+
+	hash := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(hash, "%s\x00", part)
+	}
+	binary.Key = hex.EncodeToString(hash.Sum(nil))[:16]
+	binary.Path = filepath.Join(binariesPath, binary.Key, binary.Name)
+
+	return binary.Path, binary, nil
+}
+
+// sourceRevision identifies the contents of a source tree: the git HEAD,
+// submodule revisions and a hash of uncommitted changes to tracked files
+// (untracked files are ignored), or else a hash of go.mod and go.sum.
+func sourceRevision(dir string) (string, error) {
+	head, err := git(dir, "rev-parse", "HEAD")
+	if err == nil {
+		submodules, err := git(dir, "submodule", "status", "--recursive")
+		if err != nil {
+			return "", err
+		}
+
+		diff, err := git(dir, "diff", "HEAD", "--submodule=diff")
+		if err != nil {
+			return "", err
+		}
+
+		revision := head
+		if submodules != "" || diff != "" {
+			sum := sha256.Sum256([]byte(submodules + "\x00" + diff))
+			revision = fmt.Sprintf("%s+%s", head, hex.EncodeToString(sum[:])[:12])
+		}
+		return revision, nil
+	}
+
+	hash := sha256.New()
+	found := false
+	for _, name := range []string{"go.mod", "go.sum"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		found = true
+		hash.Write(contents)
+	}
+
+	if !found {
+		return "", fmt.Errorf("cannot determine the revision of %s: it is neither a git checkout nor a go module", dir)
+	}
+	return "go.sum:" + hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+func currentGoVersion() string {
+	goVersionOnce.Do(func() {
+		output, err := exec.Command("go", "version").Output()
+		if err != nil {
+			goVersion = "unknown"
+			return
+		}
+		goVersion = strings.TrimSpace(string(output))
+	})
+	return goVersion
+}
+
+// recordBuiltBinary adds binary to the manifest of binariesPath.
+func recordBuiltBinary(binariesPath string, binary builtBinary) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	manifestPath := filepath.Join(binariesPath, "manifest.json")
+	manifest := map[string]builtBinary{}
+
+	contents, err := ioutil.ReadFile(manifestPath)
+	if err == nil {
+		err = json.Unmarshal(contents, &manifest)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %s", manifestPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	manifest[filepath.Join(binary.Key, binary.Name)] = binary
+
+	contents, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, contents, 0644)
+}
@@ -0,0 +1,114 @@
+package dusts_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("runBuilds", func() {
+	var (
+		tmpDir       string
+		binariesPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "dusts-builds-")
+		Expect(err).NotTo(HaveOccurred())
+		binariesPath = filepath.Join(tmpDir, "binaries")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	// sourceDir is a go module unless broken, in which case the revision of
+	// its source cannot be determined and the build fails before running go.
+	sourceDir := func(name string, broken bool) string {
+		dir := filepath.Join(tmpDir, name)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		if !broken {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/"+name+"\n"), 0644)).To(Succeed())
+		}
+		return dir
+	}
+
+	// cachedJob is a job whose binary is already in the cache, so that it
+	// does not run go build.
+	cachedJob := func(executable string) buildJob {
+		job := buildJob{
+			Executable:   executable,
+			BinariesPath: binariesPath,
+			SourceDir:    sourceDir(executable, false),
+			Package:      "example.com/" + executable + "/cmd/" + executable,
+		}
+		path, _, err := cachedBinaryPath(job.BinariesPath, job.SourceDir, job.Package, job.Args, job.lookupEnv)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte("binary"), 0755)).To(Succeed())
+		return job
+	}
+
+	brokenJob := func(executable string) buildJob {
+		return buildJob{
+			Executable:   executable,
+			BinariesPath: binariesPath,
+			SourceDir:    sourceDir(executable, true),
+			Package:      "example.com/" + executable + "/cmd/" + executable,
+		}
+	}
+
+	It("returns the results in the order of the jobs and every failure at once", func() {
+		jobs := []buildJob{brokenJob("bbs"), cachedJob("rep"), brokenJob("auctioneer"), cachedJob("locket")}
+
+		results, err := runBuilds(jobs, 2)
+
+		Expect(results).To(HaveLen(4))
+		for i, result := range results {
+			Expect(result.Job.Executable).To(Equal(jobs[i].Executable))
+		}
+		Expect(results[1].Cached).To(BeTrue())
+		Expect(results[1].Err).NotTo(HaveOccurred())
+		Expect(results[3].Cached).To(BeTrue())
+
+		Expect(results[0].Err).To(MatchError(HavePrefix("bbs: ")))
+		Expect(results[2].Err).To(MatchError(HavePrefix("auctioneer: ")))
+		Expect(err).To(MatchError(results[0].Err.Error() + "\n\n" + results[2].Err.Error()))
+	})
+
+	It("succeeds when every build succeeds", func() {
+		results, err := runBuilds([]buildJob{cachedJob("rep")}, 4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results[0].Path).To(BeAnExistingFile())
+	})
+
+	It("collects the executables of one binaries directory", func() {
+		v1 := cachedJob("rep")
+		v0 := cachedJob("bbs")
+		v0.BinariesPath = filepath.Join(tmpDir, "binaries-v0")
+
+		results := []buildResult{
+			{Job: v1, Path: "/v1/rep"},
+			{Job: v0, Path: "/v0/bbs"},
+		}
+		Expect(builtExecutables(results, binariesPath)).To(HaveLen(1))
+		Expect(builtExecutables(results, binariesPath)).To(HaveKeyWithValue("rep", "/v1/rep"))
+	})
+
+	Describe("the env of a job", func() {
+		It("overrides the suite's env with the env of the job", func() {
+			job := buildJob{Env: []string{"CGO_ENABLED=0"}}
+			Expect(job.lookupEnv("CGO_ENABLED")).To(Equal("0"))
+		})
+
+		It("builds GOPATH jobs with modules in auto mode", func() {
+			job := buildJob{SourceDir: "/gopath", Gopath: true}
+			Expect(job.lookupEnv("GOPATH")).To(Equal("/gopath"))
+			Expect(job.lookupEnv("GO111MODULE")).To(Equal("auto"))
+		})
+	})
+})
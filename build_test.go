@@ -0,0 +1,179 @@
+package dusts_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/inigo/world"
+)
+
+// buildJob compiles one executable. Jobs carry their own working directory
+// and env so that they can run concurrently without touching process-global
+// state.
+type buildJob struct {
+	// Executable is the key of the binary in world.BuiltExecutables.
+	Executable   string
+	BinariesPath string
+	SourceDir    string
+	Package      string
+	Args         []string
+	// Env overrides the suite's env for this build, e.g. CGO_ENABLED=0.
+	Env []string
+	// Gopath builds the package with GOPATH=SourceDir instead of as part of
+	// the module in SourceDir.
+	Gopath bool
+}
+
+type buildResult struct {
+	Job      buildJob
+	Path     string
+	Duration time.Duration
+	Cached   bool
+	Err      error
+}
+
+func (job buildJob) env() []string {
+	env := []string{}
+	if job.Gopath {
+		env = append(env, "GOPATH="+job.SourceDir, "GO111MODULE=auto")
+	}
+	return append(env, job.Env...)
+}
+
+// lookupEnv returns the value name has in the env of the build.
+func (job buildJob) lookupEnv(name string) string {
+	value := os.Getenv(name)
+	for _, kv := range job.env() {
+		if strings.HasPrefix(kv, name+"=") {
+			value = strings.TrimPrefix(kv, name+"=")
+		}
+	}
+	return value
+}
+
+func (job buildJob) run() buildResult {
+	result := buildResult{Job: job}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	binaryPath, binary, err := cachedBinaryPath(job.BinariesPath, job.SourceDir, job.Package, job.Args, job.lookupEnv)
+	if err != nil {
+		result.Err = fmt.Errorf("%s: %s", job.Executable, err)
+		return result
+	}
+	result.Path = binaryPath
+
+	if _, err := os.Stat(binaryPath); err == nil {
+		result.Cached = true
+		return result
+	}
+
+	err = os.MkdirAll(filepath.Dir(binaryPath), 0777)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	tmpPath := fmt.Sprintf("%s.%d.tmp", binaryPath, os.Getpid())
+	args := append([]string{"build", "-o", tmpPath}, job.Args...)
+	cmd := exec.Command("go", append(args, job.Package)...)
+	cmd.Dir = job.SourceDir
+	cmd.Env = append(os.Environ(), job.env()...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		result.Err = fmt.Errorf("building %s (%s) in %s failed: %s\n%s", job.Executable, job.Package, job.SourceDir, err, output)
+		return result
+	}
+
+	err = os.Rename(tmpPath, binaryPath)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	binary.BuiltAt = time.Now()
+	result.Err = recordBuiltBinary(job.BinariesPath, binary)
+	return result
+}
+
+// buildConcurrency is how many builds runBuilds runs at once. It defaults
+// to the number of CPUs and can be set with DUSTS_BUILD_CONCURRENCY.
+func buildConcurrency() int {
+	if suite.BuildConcurrency > 0 {
+		return suite.BuildConcurrency
+	}
+	return runtime.NumCPU()
+}
+
+// runBuilds runs every job and returns all results, in the order of jobs,
+// along with an error combining every failed build.
+func runBuilds(jobs []buildJob, concurrency int) ([]buildResult, error) {
+	results := make([]buildResult, len(jobs))
+	work := make(chan int)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = jobs[i].run()
+			}
+		}()
+	}
+
+	for i := range jobs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	failures := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failures = append(failures, result.Err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return results, errors.New(strings.Join(failures, "\n\n"))
+	}
+	return results, nil
+}
+
+// builtExecutables collects the binaries built into binariesPath.
+func builtExecutables(results []buildResult, binariesPath string) world.BuiltExecutables {
+	executables := world.BuiltExecutables{}
+	for _, result := range results {
+		if result.Job.BinariesPath == binariesPath {
+			executables[result.Job.Executable] = result.Path
+		}
+	}
+	return executables
+}
+
+func printBuildTimes(results []buildResult) {
+	sorted := append([]buildResult{}, results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Duration > sorted[j].Duration })
+
+	for _, result := range sorted {
+		status := "built"
+		switch {
+		case result.Err != nil:
+			status = "failed"
+		case result.Cached:
+			status = "cached"
+		}
+		fmt.Printf("%-8s %-60s %s\n", status, filepath.Join(result.Job.BinariesPath, result.Job.Executable), result.Duration.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,526 @@
+package dusts_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/inigo/helpers"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/route-emitter/cfroutes"
+	"code.cloudfoundry.org/route-emitter/tcp_routes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	canaryMemoryMB = 128
+	// instanceRoundInterval is how often every instance of a canary is polled.
+	instanceRoundInterval = 250 * time.Millisecond
+)
+
+var instanceHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+// canaryApp is an LRP kept running through the upgrade with its own route.
+// Apps with more than one instance must keep all but one of them routable
+// through every step.
+type canaryApp struct {
+	Name      string
+	Host      string
+	Instances int
+	MemoryMB  int
+	// DockerRootFS is the docker:// image the app runs from through the
+	// docker app lifecycle, instead of the go-server zip on the file server.
+	DockerRootFS string
+	// TCP apps also get a TCP route, which their route poller uses instead
+	// of the HTTP route.
+	TCP bool
+	// SSH apps run sshd next to the app. Their first instance is polled with
+	// new sessions through ssh-proxy and kept busy with a held session.
+	SSH bool
+
+	route            *poller
+	routeProcess     ifrit.Process
+	instances        *instancePoller
+	instancesProcess ifrit.Process
+	ssh              *poller
+	sshProcess       ifrit.Process
+	sessions         *sessionHolder
+	sessionsProcess  ifrit.Process
+}
+
+// canarySet is the workload of a RollingUpgrade spec: a single-instance app
+// on the default route, an app spread across every cell, a second
+// multi-instance app, an app with more instances than one cell can hold, an
+// app running from a docker image and, when the spec routes TCP, an app with
+// a TCP route. The single-instance app can also be reachable over SSH.
+type canarySet struct {
+	apps []*canaryApp
+	tcp  *tcpRouting
+}
+
+// largeCanaryInstances is how many instances the large app has. It is sized
+// so that no cell can hold all of them.
+const largeCanaryInstances = 3
+
+// newCanarySet sizes the canaries for the registered cells. Each instance of
+// the large app gets just over a third of the largest cell, so no cell holds
+// all three, and it fails unless the cells still have room for all of them
+// next to the other canaries, spread evenly. The single-instance app is only
+// reachable over SSH if the plan starts an ssh-proxy.
+func newCanarySet(cells []*models.CellPresence, dockerRootFS string, tcp *tcpRouting, sshProxy bool) (*canarySet, error) {
+	set := &canarySet{tcp: tcp, apps: []*canaryApp{
+		{Name: "dust-canary", Host: helpers.DefaultHost, Instances: 1, MemoryMB: canaryMemoryMB, SSH: sshProxy},
+		{Name: "dust-canary-spread", Instances: 2 * len(cells), MemoryMB: canaryMemoryMB},
+		{Name: "dust-canary-pair", Instances: 2, MemoryMB: canaryMemoryMB},
+		{Name: "dust-canary-docker", Instances: 1, MemoryMB: canaryMemoryMB, DockerRootFS: dockerRootFS},
+	}}
+	if tcp != nil {
+		set.apps = append(set.apps, &canaryApp{Name: "dust-canary-tcp", Instances: 2, MemoryMB: canaryMemoryMB, TCP: true})
+	}
+	if len(cells) == 0 {
+		return nil, errors.New("no cells to size the canaries for")
+	}
+
+	reserved := 0
+	for _, app := range set.apps {
+		reserved += app.Instances * app.MemoryMB
+	}
+	reservedPerCell := (reserved + len(cells) - 1) / len(cells)
+
+	largestCellMB := 0
+	for _, cell := range cells {
+		if memory := int(cell.Capacity.MemoryMb); memory > largestCellMB {
+			largestCellMB = memory
+		}
+	}
+
+	large := largestCellMB/largeCanaryInstances + 1
+	if large < canaryMemoryMB {
+		large = canaryMemoryMB
+	}
+
+	slots := 0
+	for _, cell := range cells {
+		if free := int(cell.Capacity.MemoryMb) - reservedPerCell; free > 0 {
+			slots += free / large
+		}
+	}
+	if slots < largeCanaryInstances {
+		return nil, fmt.Errorf("%d cells with at most %dMB cannot run %d instances of %dMB next to %dMB of other canaries", len(cells), largestCellMB, largeCanaryInstances, large, reserved)
+	}
+	set.apps = append(set.apps, &canaryApp{Name: "dust-canary-large", Instances: largeCanaryInstances, MemoryMB: large})
+
+	for _, app := range set.apps {
+		if app.Host == "" {
+			app.Host = app.Name
+		}
+	}
+	return set, nil
+}
+
+// Start desires every canary, waits for all of their instances to run and
+// starts a route poller per app and an instance poller per multi-instance
+// app.
+func (s *canarySet) Start() {
+	for _, app := range s.apps {
+		lrp := helpers.DefaultLRPCreateRequest(ComponentMakerV0.Addresses(), app.Name, app.Name, app.Instances)
+		lrp.MemoryMb = int32(app.MemoryMB)
+		if app.DockerRootFS != "" {
+			useDockerLifecycle(lrp, app.DockerRootFS)
+		}
+
+		routes, err := cfroutes.CFRoutesFromRoutingInfo(*lrp.Routes)
+		Expect(err).NotTo(HaveOccurred())
+		for i := range routes {
+			routes[i].Hostnames = []string{app.Host}
+		}
+		routingInfo := routes.RoutingInfo()
+		if app.TCP {
+			routerGroupGUID, err := s.tcp.RouterGroupGUID()
+			Expect(err).NotTo(HaveOccurred())
+			tcpRoutes := tcp_routes.TCPRoutes{{
+				RouterGroupGuid: routerGroupGUID,
+				ExternalPort:    uint32(s.tcp.externalPort),
+				ContainerPort:   8080,
+			}}
+			for key, value := range *tcpRoutes.RoutingInfo() {
+				routingInfo[key] = value
+			}
+		}
+		lrp.Routes = &routingInfo
+		if app.SSH {
+			useSSHD(lrp)
+		}
+
+		fmt.Fprintf(GinkgoWriter, "desiring %s: %d instances of %dMB at %s\n", app.Name, app.Instances, app.MemoryMB, app.Host)
+		Expect(bbsClient.DesireLRP(logger, lrp)).To(Succeed())
+	}
+
+	for _, app := range s.apps {
+		Eventually(func() int {
+			return runningInstances(app.Name)
+		}).Should(Equal(app.Instances), "%s did not start all of its instances", app.Name)
+	}
+
+	for _, app := range s.apps {
+		if app.TCP {
+			app.route = NewTCPPoller(logger, s.tcp.RouterAddr())
+		} else {
+			app.route = NewPoller(logger, ComponentMakerV0.Addresses().Router, app.Host)
+		}
+		app.routeProcess = ifrit.Background(app.route)
+		Eventually(app.routeProcess.Ready()).Should(BeClosed(), "%s did not become routable", app.Name)
+
+		if app.Instances > 1 {
+			app.instances = newInstancePoller(logger, ComponentMakerV0.Addresses().Router, app)
+			app.instancesProcess = ifrit.Background(app.instances)
+			Eventually(app.instancesProcess.Ready()).Should(BeClosed(), "not every instance of %s became routable", app.Name)
+		}
+
+		if app.SSH {
+			sshProxyAddr := ComponentMakerV0.Addresses().SSHProxy
+			app.ssh = NewSSHPoller(logger, sshProxyAddr, app.Name, 0)
+			app.sshProcess = ifrit.Background(app.ssh)
+			Eventually(app.sshProcess.Ready()).Should(BeClosed(), "could not open an SSH session to %s", app.Name)
+
+			app.sessions = newSessionHolder(logger, sshProxyAddr, app.Name, 0)
+			app.sessionsProcess = ifrit.Background(app.sessions)
+			Eventually(app.sessionsProcess.Ready()).Should(BeClosed())
+		}
+	}
+}
+
+// dockerLifecycleAsset is where setupPlumbing puts the docker app lifecycle
+// on the file server.
+const dockerLifecycleAsset = "docker_app_lifecycle.tgz"
+
+// useDockerLifecycle turns the default LRP into one that runs from a docker
+// image the way Cloud Controller desires docker apps: the launcher of the
+// docker app lifecycle runs the entrypoint of the image as root and its
+// healthcheck monitors the port.
+func useDockerLifecycle(lrp *models.DesiredLRP, rootFS string) {
+	lrp.RootFs = rootFS
+	lrp.Setup = models.WrapAction(&models.DownloadAction{
+		User:     "root",
+		From:     fmt.Sprintf("http://%s/v1/static/%s", ComponentMakerV0.Addresses().FileServer, dockerLifecycleAsset),
+		To:       "/tmp/lifecycle",
+		CacheKey: "docker-lifecycle",
+	})
+	lrp.Action = models.WrapAction(&models.RunAction{
+		User: "root",
+		Path: "/tmp/lifecycle/launcher",
+		Args: []string{"app", "", `{"entrypoint":["/go-server"]}`},
+		Env:  []*models.EnvironmentVariable{{Name: "PORT", Value: "8080"}},
+	})
+	lrp.Monitor = models.WrapAction(&models.RunAction{
+		User: "root",
+		Path: "/tmp/lifecycle/healthcheck",
+		Args: []string{"-port=8080"},
+	})
+}
+
+func runningInstances(processGuid string) int {
+	lrps, err := bbsClient.ActualLRPs(logger, models.ActualLRPFilter{ProcessGuid: processGuid})
+	if err != nil {
+		return 0
+	}
+	running := 0
+	for _, lrp := range lrps {
+		if lrp.State == models.ActualLRPStateRunning && lrp.Presence == models.ActualLRP_Ordinary {
+			running++
+		}
+	}
+	return running
+}
+
+// Processes returns the running pollers so they can be stopped.
+func (s *canarySet) Processes() []ifrit.Process {
+	processes := []ifrit.Process{}
+	for _, app := range s.apps {
+		if app.routeProcess != nil {
+			processes = append(processes, app.routeProcess)
+		}
+		if app.instancesProcess != nil {
+			processes = append(processes, app.instancesProcess)
+		}
+		if app.sshProcess != nil {
+			processes = append(processes, app.sshProcess, app.sessionsProcess)
+		}
+	}
+	return processes
+}
+
+func (s *canarySet) RouteStatsByStep() []PollerStats {
+	stats := []PollerStats{}
+	for _, app := range s.apps {
+		if app.route != nil {
+			stats = append(stats, app.route.StatsByStep()...)
+		}
+		if app.ssh != nil {
+			stats = append(stats, app.ssh.StatsByStep()...)
+		}
+	}
+	return stats
+}
+
+func (s *canarySet) RouteStatsBetween(step string, start, end time.Time) []PollerStats {
+	stats := []PollerStats{}
+	for _, app := range s.apps {
+		if app.route != nil {
+			routeStats := app.route.StatsBetween(start, end)
+			routeStats.Step = step
+			stats = append(stats, routeStats)
+		}
+		if app.ssh != nil {
+			sshStats := app.ssh.StatsBetween(start, end)
+			sshStats.Step = step
+			stats = append(stats, sshStats)
+		}
+	}
+	return stats
+}
+
+func (s *canarySet) InstanceStatsByStep() []instanceStats {
+	stats := []instanceStats{}
+	for _, app := range s.apps {
+		if app.instances != nil {
+			stats = append(stats, app.instances.StatsByStep()...)
+		}
+	}
+	return stats
+}
+
+func (s *canarySet) InstanceStatsBetween(step string, start, end time.Time) []instanceStats {
+	stats := []instanceStats{}
+	for _, app := range s.apps {
+		if app.instances != nil {
+			appStats := app.instances.StatsBetween(start, end)
+			appStats.Step = step
+			stats = append(stats, appStats)
+		}
+	}
+	return stats
+}
+
+// SSHSessions returns the held SSH sessions that ended.
+func (s *canarySet) SSHSessions() []heldSession {
+	sessions := []heldSession{}
+	for _, app := range s.apps {
+		if app.sessions != nil {
+			sessions = append(sessions, app.sessions.Sessions()...)
+		}
+	}
+	return sessions
+}
+
+// Verify checks every route against the availability budget, SSH against
+// sshBudget, every multi-instance app for steps during which fewer than N-1
+// of its instances were routable and every held SSH session for hangs.
+// During kill steps every route is checked against faultBudget instead, and
+// instances may be lost until the cluster converges.
+func (s *canarySet) Verify() error {
+	routeStats := s.RouteStatsByStep()
+	instanceStats := s.InstanceStatsByStep()
+	for _, stats := range routeStats {
+		fmt.Fprintln(GinkgoWriter, stats)
+	}
+	for _, stats := range instanceStats {
+		fmt.Fprintln(GinkgoWriter, stats)
+	}
+
+	fmt.Fprint(GinkgoWriter, describeSessions(s.SSHSessions()))
+
+	violations := []string{}
+	faults := upgradeSteps.Faults()
+	routes, sshRoutes, faultRoutes := []PollerStats{}, []PollerStats{}, []PollerStats{}
+	for _, stats := range routeStats {
+		switch {
+		case faults[stats.Step]:
+			faultRoutes = append(faultRoutes, stats)
+		case strings.HasPrefix(stats.Route, "ssh://"):
+			sshRoutes = append(sshRoutes, stats)
+		default:
+			routes = append(routes, stats)
+		}
+	}
+	if err := canaryBudget.Verify(routes); err != nil {
+		violations = append(violations, err.Error())
+	}
+	if err := sshBudget.Verify(sshRoutes); err != nil {
+		violations = append(violations, err.Error())
+	}
+	if err := faultBudget.Verify(faultRoutes); err != nil {
+		violations = append(violations, err.Error())
+	}
+	for _, app := range s.apps {
+		if app.sessions != nil {
+			if err := app.sessions.Verify(); err != nil {
+				violations = append(violations, err.Error())
+			}
+		}
+	}
+	for _, stats := range instanceStats {
+		if stats.Rounds > 0 && stats.MinRoutable < stats.Instances-1 && !faults[stats.Step] {
+			violations = append(violations, fmt.Sprintf("%s: %s had only %d of %d instances routable", stats.Step, stats.App, stats.MinRoutable, stats.Instances))
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("%s", strings.Join(violations, "\n"))
+	}
+	return nil
+}
+
+// instanceSample is one round of requests to every instance of an app.
+type instanceSample struct {
+	Time     time.Time
+	Step     string
+	Routable int
+}
+
+// instancePoller polls each instance of an app through the router using the
+// X-CF-APP-INSTANCE header, which gorouter matches against the app guid (the
+// log guid of the LRP) and instance index registered by the route emitter.
+type instancePoller struct {
+	logger     lager.Logger
+	routerAddr string
+	app        *canaryApp
+
+	mu      sync.Mutex
+	samples []instanceSample
+}
+
+func newInstancePoller(logger lager.Logger, routerAddr string, app *canaryApp) *instancePoller {
+	return &instancePoller{
+		logger:     logger.Session("instance-poller", lager.Data{"app": app.Name}),
+		routerAddr: routerAddr,
+		app:        app,
+	}
+}
+
+// Run waits for every instance to be routable, then records a round of
+// requests every instanceRoundInterval until signalled.
+func (p *instancePoller) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	defer GinkgoRecover()
+
+	ticker := time.NewTicker(instanceRoundInterval)
+	defer ticker.Stop()
+
+	for p.routable() < p.app.Instances {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+		}
+	}
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			p.logger.Info("exiting-instance-poller")
+			return nil
+		case <-ticker.C:
+			sample := instanceSample{Time: time.Now(), Step: upgradeSteps.Current()}
+			sample.Routable = p.routable()
+			if sample.Routable < p.app.Instances {
+				p.logger.Info("instances-unroutable", lager.Data{"routable": sample.Routable, "instances": p.app.Instances, "step": sample.Step})
+			}
+
+			p.mu.Lock()
+			p.samples = append(p.samples, sample)
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *instancePoller) routable() int {
+	routable := 0
+	for index := 0; index < p.app.Instances; index++ {
+		req, err := http.NewRequest("GET", "http://"+p.routerAddr+"/", nil)
+		if err != nil {
+			continue
+		}
+		req.Host = p.app.Host
+		req.Header.Set("X-CF-APP-INSTANCE", fmt.Sprintf("%s:%d", p.app.Name, index))
+
+		resp, err := instanceHTTPClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			routable++
+		}
+	}
+	return routable
+}
+
+func (p *instancePoller) Samples() []instanceSample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]instanceSample{}, p.samples...)
+}
+
+// StatsByStep summarizes the rounds taken during each upgrade step, in the
+// order the steps ran.
+func (p *instancePoller) StatsByStep() []instanceStats {
+	stats := []instanceStats{}
+
+	samples := p.Samples()
+	for start := 0; start < len(samples); {
+		end := start
+		for end < len(samples) && samples[end].Step == samples[start].Step {
+			end++
+		}
+
+		s := p.computeStats(samples[start:end])
+		s.Step = samples[start].Step
+		stats = append(stats, s)
+		start = end
+	}
+
+	return stats
+}
+
+// StatsBetween summarizes the rounds taken in [start, end). A zero end
+// includes every round after start.
+func (p *instancePoller) StatsBetween(start, end time.Time) instanceStats {
+	samples := []instanceSample{}
+	for _, sample := range p.Samples() {
+		if sample.Time.Before(start) || (!end.IsZero() && !sample.Time.Before(end)) {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return p.computeStats(samples)
+}
+
+type instanceStats struct {
+	App         string `json:"app"`
+	Step        string `json:"step,omitempty"`
+	Instances   int    `json:"instances"`
+	Rounds      int    `json:"rounds"`
+	MinRoutable int    `json:"min_routable"`
+}
+
+func (s instanceStats) String() string {
+	return fmt.Sprintf("%s: %s: %d rounds, at least %d of %d instances routable", s.Step, s.App, s.Rounds, s.MinRoutable, s.Instances)
+}
+
+func (p *instancePoller) computeStats(samples []instanceSample) instanceStats {
+	stats := instanceStats{App: p.app.Name, Instances: p.app.Instances, Rounds: len(samples), MinRoutable: p.app.Instances}
+	for _, sample := range samples {
+		if sample.Routable < stats.MinRoutable {
+			stats.MinRoutable = sample.Routable
+		}
+	}
+	return stats
+}
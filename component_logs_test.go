@@ -0,0 +1,317 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+)
+
+// componentLogFiles splits the output of the upgraded components into one
+// file per instance and version, e.g. rep-1.v0.log, so that V0 and V1 output
+// is not interleaved in componentLogs.
+var componentLogFiles *componentLogDir
+
+type componentLogDir struct {
+	mu      sync.Mutex
+	dir     string
+	files   map[string]*os.File
+	entries []*componentLogEntry
+	// upgraded is when MarkUpgraded was called for each spec.
+	upgraded map[string]time.Time
+}
+
+// componentLogEntry is one process lifetime in the index file. A file holds
+// several lifetimes when an instance runs the same version more than once.
+type componentLogEntry struct {
+	File      string    `json:"file"`
+	Spec      string    `json:"spec"`
+	Component string    `json:"component"`
+	Index     int       `json:"index"`
+	Version   string    `json:"version"`
+	Release   string    `json:"release"`
+	Started   time.Time `json:"started"`
+	Stopped   time.Time `json:"stopped"`
+	ExitError string    `json:"exit_error,omitempty"`
+
+	// StartOffset and StopOffset delimit the output of this lifetime in File.
+	// StopOffset is 0 while the process is running.
+	StartOffset int64 `json:"start_offset"`
+	StopOffset  int64 `json:"stop_offset"`
+
+	// UpgradedOffset is the end of File when the last upgrade step of the
+	// spec finished, or 0 if the process was not running then.
+	UpgradedOffset int64 `json:"upgraded_offset,omitempty"`
+}
+
+func newComponentLogDir(dir string) (*componentLogDir, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &componentLogDir{
+		dir:      dir,
+		files:    map[string]*os.File{},
+		upgraded: map[string]time.Time{},
+	}, nil
+}
+
+// Invoke starts runner with start, with the output of the process going to
+// the log file of the instance, and records the lifetime of the process in
+// the index.
+func (d *componentLogDir) Invoke(component string, index, generation int, runner ifrit.Runner, start func(ifrit.Runner) ifrit.Process) ifrit.Process {
+	name := fmt.Sprintf("%s-%d.v%d.log", component, index, generation)
+	file, err := d.open(name)
+	if err != nil {
+		recordFailure(fmt.Sprintf("failed to open component log %s: %s", name, err), 1)
+	}
+
+	entry := &componentLogEntry{
+		File:        name,
+		Spec:        CurrentGinkgoTestDescription().FullTestText,
+		Component:   component,
+		Index:       index,
+		Version:     fmt.Sprintf("v%d", generation),
+		Release:     generationName(generation),
+		Started:     time.Now(),
+		StartOffset: fileSize(file),
+	}
+	d.add(entry)
+
+	process := start(withOutput(runner, file))
+
+	go func() {
+		err := <-process.Wait()
+		d.stopped(entry, fileSize(file), err)
+	}()
+
+	return process
+}
+
+// withOutput makes a ginkgomon runner write the output of its process to out
+// instead of GinkgoWriter. Other runners are returned as they are.
+func withOutput(runner ifrit.Runner, out io.Writer) ifrit.Runner {
+	r, ok := runner.(*ginkgomon.Runner)
+	if !ok {
+		return runner
+	}
+	return &loggedRunner{runner: r, out: out, sessionReady: make(chan struct{})}
+}
+
+// loggedRunner runs the command of a ginkgomon runner the way ginkgomon does,
+// but with the output going to out. Several processes start at once, so
+// pointing the shared GinkgoWriter at the file of each would race.
+type loggedRunner struct {
+	runner       *ginkgomon.Runner
+	out          io.Writer
+	session      *gexec.Session
+	sessionReady chan struct{}
+}
+
+func (r *loggedRunner) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	defer GinkgoRecover()
+
+	allOutput := gbytes.NewBuffer()
+	prefixed := func(stream string) io.Writer {
+		color := "32m"
+		if stream == "e" {
+			color = "91m"
+		}
+		return gexec.NewPrefixedWriter(
+			fmt.Sprintf("\x1b[%s[%s]\x1b[%s[%s]\x1b[0m ", color, stream, r.runner.AnsiColorCode, r.runner.Name),
+			io.MultiWriter(allOutput, r.out),
+		)
+	}
+
+	session, err := gexec.Start(r.runner.Command, prefixed("o"), prefixed("e"))
+	Expect(err).NotTo(HaveOccurred(), "%s failed to start", r.runner.Name)
+	r.session = session
+	close(r.sessionReady)
+
+	startCheckTimeout := r.runner.StartCheckTimeout
+	if startCheckTimeout == 0 {
+		startCheckTimeout = 5 * time.Second
+	}
+	var startCheckTimer <-chan time.Time
+	if r.runner.StartCheck != "" {
+		startCheckTimer = time.After(startCheckTimeout)
+	}
+	detectStartCheck := allOutput.Detect(r.runner.StartCheck)
+
+	for {
+		select {
+		case <-detectStartCheck:
+			allOutput.CancelDetects()
+			startCheckTimer = nil
+			detectStartCheck = nil
+			close(ready)
+		case <-startCheckTimer:
+			session.Terminate().Wait(10 * time.Second)
+			return fmt.Errorf("did not see %s in the output of %s within %s", r.runner.StartCheck, r.runner.Name, startCheckTimeout)
+		case signal := <-signals:
+			session.Signal(signal)
+		case <-session.Exited:
+			if r.runner.Cleanup != nil {
+				r.runner.Cleanup()
+			}
+			if session.ExitCode() == 0 {
+				return nil
+			}
+			return fmt.Errorf("exit status %d", session.ExitCode())
+		}
+	}
+}
+
+// Buffer is the output of the process, like that of a ginkgomon runner.
+func (r *loggedRunner) Buffer() *gbytes.Buffer {
+	<-r.sessionReady
+	return r.session.Buffer()
+}
+
+func (d *componentLogDir) open(name string) (*os.File, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if file, ok := d.files[name]; ok {
+		return file, nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(d.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.files[name] = file
+	return file, nil
+}
+
+func (d *componentLogDir) add(entry *componentLogEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, entry)
+	d.writeIndex()
+}
+
+func (d *componentLogDir) stopped(entry *componentLogEntry, offset int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry.Stopped = time.Now()
+	entry.StopOffset = offset
+	if err != nil {
+		entry.ExitError = err.Error()
+	}
+	d.writeIndex()
+}
+
+// writeIndex must be called with d.mu held. Failing to write the index only
+// loses diagnostics, so errors are reported without failing the spec.
+func (d *componentLogDir) writeIndex() {
+	index, err := json.MarshalIndent(d.entries, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(d.dir, "index.json"), index, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(GinkgoWriter, "failed to write component log index: %s\n", err)
+	}
+}
+
+// MarkUpgraded records where the output of every process of spec that is
+// still running ends once its last upgrade step finished, so that
+// UpgradeOutput leaves out what the processes log while they are shut down.
+func (d *componentLogDir) MarkUpgraded(spec string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.upgraded[spec] = time.Now()
+	for _, entry := range d.entries {
+		if entry.Spec == spec && entry.Stopped.IsZero() {
+			entry.UpgradedOffset = fileSize(d.files[entry.File])
+		}
+	}
+	d.writeIndex()
+}
+
+// Entries returns the process lifetimes started by the given spec.
+func (d *componentLogDir) Entries(spec string) []componentLogEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries := []componentLogEntry{}
+	for _, entry := range d.entries {
+		if entry.Spec == spec {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// Output returns what the process logged during the given lifetime.
+func (d *componentLogDir) Output(entry componentLogEntry) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(d.dir, entry.File))
+	if err != nil {
+		return nil, err
+	}
+
+	end := int64(len(contents))
+	if entry.StopOffset > 0 && entry.StopOffset < end {
+		end = entry.StopOffset
+	}
+	if entry.StartOffset > end {
+		return nil, nil
+	}
+	return contents[entry.StartOffset:end], nil
+}
+
+// UpgradeOutput returns what the process logged during the given lifetime
+// until the upgrade of its spec finished. It is all of Output if the spec
+// never got there.
+func (d *componentLogDir) UpgradeOutput(entry componentLogEntry) ([]byte, error) {
+	output, err := d.Output(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	upgraded, ok := d.upgraded[entry.Spec]
+	d.mu.Unlock()
+
+	switch {
+	case !ok:
+		return output, nil
+	case entry.Started.After(upgraded):
+		return nil, nil
+	case entry.UpgradedOffset > 0:
+		end := entry.UpgradedOffset - entry.StartOffset
+		if end < int64(len(output)) {
+			return output[:end], nil
+		}
+	}
+	return output, nil
+}
+
+func fileSize(file *os.File) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (d *componentLogDir) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, file := range d.files {
+		file.Close()
+	}
+}
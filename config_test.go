@@ -0,0 +1,285 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/durationjson"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// suiteConfig is the configuration of the suite. It is read from the JSON or
+// YAML file in DUSTS_CONFIG, if set, on top of defaultSuiteConfig, and the
+// env vars named in the comments override it.
+type suiteConfig struct {
+	// DiegoVersionV0 is DIEGO_VERSION_V0.
+	DiegoVersionV0 string `json:"diego_version_v0"`
+	// DiegoIntermediateVersions is DIEGO_INTERMEDIATE_VERSIONS.
+	DiegoIntermediateVersions string `json:"diego_intermediate_versions"`
+
+	// GraceTarballURL is GRACE_TARBALL_URL.
+	GraceTarballURL string `json:"grace_tarball_url"`
+	// GraceTarballChecksum is GRACE_TARBALL_CHECKSUM.
+	GraceTarballChecksum string `json:"grace_tarball_checksum"`
+	// DefaultRootFS is DEFAULT_ROOTFS.
+	DefaultRootFS string `json:"default_rootfs"`
+
+	// ComponentLogPath is DUSTS_COMPONENT_LOG_PATH.
+	ComponentLogPath string `json:"component_log_path"`
+	// UpgradePlan is DUSTS_UPGRADE_PLAN.
+	UpgradePlan string `json:"upgrade_plan"`
+
+	// Gopaths maps GOPATH env vars, e.g. REP_GOPATH_V0, to source checkouts.
+	// Set env vars take precedence.
+	Gopaths map[string]string `json:"gopaths"`
+	// FileServerGopathV0 is FILE_SERVER_GOPATH_V0, the GOPATH the V0 file
+	// server is built from when a V0 upgrade plan starts one. It defaults to
+	// the GOPATH_V0 checkout of diego-release.
+	FileServerGopathV0 string `json:"file_server_gopath_v0"`
+	// PrebuiltBinaries maps DUSTS_PREBUILT_BINARIES* env vars to directories
+	// or manifests of prebuilt executables. Set env vars take precedence.
+	PrebuiltBinaries map[string]string `json:"prebuilt_binaries"`
+	// BuildConcurrency is DUSTS_BUILD_CONCURRENCY. 0 means one build per CPU.
+	BuildConcurrency int `json:"build_concurrency"`
+
+	// Cells is DUSTS_CELLS, the number of cells started by the upgrade plans.
+	// 0 means the number in the plan.
+	Cells int `json:"cells"`
+	// MaxInFlight is DUSTS_MAX_IN_FLIGHT, how many cells are upgraded at once.
+	// 0 means the number in the plan.
+	MaxInFlight int `json:"max_in_flight"`
+	// UpgradeOrders is DUSTS_UPGRADE_ORDERS: "all" adds a RollingUpgrade spec
+	// for every order of the first plan's steps its dependencies allow, a
+	// number n adds specs for a random sample of n of them, and "" only runs
+	// the plan in its own order.
+	UpgradeOrders string `json:"upgrade_orders"`
+	// UpgradeOrderSeed is DUSTS_UPGRADE_ORDER_SEED, the seed of the sample of
+	// orders. 0 picks one from the time.
+	UpgradeOrderSeed int64 `json:"upgrade_order_seed"`
+
+	// VizziniNodes is DUSTS_VIZZINI_NODES.
+	VizziniNodes int `json:"vizzini_nodes"`
+	// EvacuationTimeout is DUSTS_EVACUATION_TIMEOUT, the rep evacuation
+	// timeout set by the short-evacuation-timeout mutator.
+	EvacuationTimeout durationjson.Duration `json:"evacuation_timeout"`
+
+	Ports  portConfig   `json:"ports"`
+	Poller pollerConfig `json:"poller"`
+}
+
+// portConfig is the range of ports handed out by the port allocator: node n
+// gets RangeSize ports starting at n*RangeStride.
+type portConfig struct {
+	// RangeStride is DUSTS_PORT_RANGE_STRIDE.
+	RangeStride int `json:"range_stride"`
+	// RangeSize is DUSTS_PORT_RANGE_SIZE.
+	RangeSize int `json:"range_size"`
+}
+
+// pollerConfig configures the canary pollers and their availability budget.
+type pollerConfig struct {
+	// FailureBackoff is DUSTS_POLLER_FAILURE_BACKOFF, how long a poller waits
+	// after a failed request.
+	FailureBackoff durationjson.Duration `json:"failure_backoff"`
+	// Retries is DUSTS_POLLER_RETRIES, how many times a poller retries a
+	// request answered with 404 Not Found, FailureBackoff apart, before it
+	// records the request as failed. Retries hide unavailable windows up to
+	// Retries*FailureBackoff long from the budget, so it defaults to 0.
+	Retries int `json:"retries"`
+	// MaxUnavailable is DUSTS_MAX_UNAVAILABLE.
+	MaxUnavailable durationjson.Duration `json:"max_unavailable"`
+	// MaxLatencyP99 is DUSTS_MAX_LATENCY_P99.
+	MaxLatencyP99 durationjson.Duration `json:"max_latency_p99"`
+	// MaxRecovery is DUSTS_MAX_RECOVERY, how long the cluster may take to
+	// converge after a kill step, and how long a route may be unavailable
+	// during one.
+	MaxRecovery durationjson.Duration `json:"max_recovery"`
+}
+
+func defaultSuiteConfig() suiteConfig {
+	return suiteConfig{
+		GraceTarballURL:   "https://storage.googleapis.com/diego-assets-bucket/grace.tar.gz",
+		Gopaths:           map[string]string{},
+		PrebuiltBinaries:  map[string]string{},
+		VizziniNodes:      4,
+		EvacuationTimeout: durationjson.Duration(10 * time.Second),
+		Ports: portConfig{
+			RangeStride: 2000,
+			RangeSize:   5000,
+		},
+		Poller: pollerConfig{
+			FailureBackoff: durationjson.Duration(100 * time.Millisecond),
+			MaxUnavailable: durationjson.Duration(2 * time.Second),
+			MaxLatencyP99:  durationjson.Duration(500 * time.Millisecond),
+			MaxRecovery:    durationjson.Duration(time.Minute),
+		},
+	}
+}
+
+// suite is resolved at package initialization since v0Release depends on it.
+// BeforeSuite fails on suiteConfigErr.
+var suite, suiteConfigErr = loadSuiteConfig(os.Getenv("DUSTS_CONFIG"))
+
+// loadSuiteConfig reads the config file at path, if any, and applies the env
+// overrides. The config is usable even when an error is returned.
+func loadSuiteConfig(path string) (suiteConfig, error) {
+	config := defaultSuiteConfig()
+
+	if path != "" {
+		err := config.load(path)
+		if err != nil {
+			config = defaultSuiteConfig()
+			config.applyEnv()
+			return config, fmt.Errorf("DUSTS_CONFIG %s: %s", path, err)
+		}
+	}
+
+	return config, config.applyEnv()
+}
+
+// load reads a JSON or, if path ends in .yml or .yaml, YAML config. YAML is
+// converted to JSON first so both share the json tags.
+func (c *suiteConfig) load(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		var document interface{}
+		err = yaml.Unmarshal(contents, &document)
+		if err != nil {
+			return err
+		}
+		contents, err = json.Marshal(jsonCompatible(document))
+		if err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(contents)))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(c)
+}
+
+// jsonCompatible turns the map[interface{}]interface{} maps produced by
+// yaml.v2 into maps json can marshal.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[fmt.Sprintf("%v", key)] = jsonCompatible(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// applyEnv overrides the config with the env vars that are set.
+func (c *suiteConfig) applyEnv() error {
+	problems := []string{}
+
+	overrideString := func(value *string, name string) {
+		if env := os.Getenv(name); env != "" {
+			*value = env
+		}
+	}
+	overrideInt := func(value *int, name string) {
+		if env := os.Getenv(name); env != "" {
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+				return
+			}
+			*value = n
+		}
+	}
+	overrideInt64 := func(value *int64, name string) {
+		if env := os.Getenv(name); env != "" {
+			n, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+				return
+			}
+			*value = n
+		}
+	}
+	overrideDuration := func(value *durationjson.Duration, name string) {
+		if env := os.Getenv(name); env != "" {
+			d, err := time.ParseDuration(env)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+				return
+			}
+			*value = durationjson.Duration(d)
+		}
+	}
+
+	overrideString(&c.DiegoVersionV0, "DIEGO_VERSION_V0")
+	overrideString(&c.DiegoIntermediateVersions, "DIEGO_INTERMEDIATE_VERSIONS")
+	overrideString(&c.GraceTarballURL, "GRACE_TARBALL_URL")
+	overrideString(&c.GraceTarballChecksum, "GRACE_TARBALL_CHECKSUM")
+	overrideString(&c.DefaultRootFS, "DEFAULT_ROOTFS")
+	overrideString(&c.ComponentLogPath, "DUSTS_COMPONENT_LOG_PATH")
+	overrideString(&c.UpgradePlan, "DUSTS_UPGRADE_PLAN")
+	overrideString(&c.FileServerGopathV0, "FILE_SERVER_GOPATH_V0")
+	overrideInt(&c.BuildConcurrency, "DUSTS_BUILD_CONCURRENCY")
+	overrideInt(&c.Cells, "DUSTS_CELLS")
+	overrideInt(&c.MaxInFlight, "DUSTS_MAX_IN_FLIGHT")
+	overrideString(&c.UpgradeOrders, "DUSTS_UPGRADE_ORDERS")
+	overrideInt64(&c.UpgradeOrderSeed, "DUSTS_UPGRADE_ORDER_SEED")
+	overrideInt(&c.VizziniNodes, "DUSTS_VIZZINI_NODES")
+	overrideDuration(&c.EvacuationTimeout, "DUSTS_EVACUATION_TIMEOUT")
+	overrideInt(&c.Ports.RangeStride, "DUSTS_PORT_RANGE_STRIDE")
+	overrideInt(&c.Ports.RangeSize, "DUSTS_PORT_RANGE_SIZE")
+	overrideDuration(&c.Poller.FailureBackoff, "DUSTS_POLLER_FAILURE_BACKOFF")
+	overrideInt(&c.Poller.Retries, "DUSTS_POLLER_RETRIES")
+	overrideDuration(&c.Poller.MaxUnavailable, "DUSTS_MAX_UNAVAILABLE")
+	overrideDuration(&c.Poller.MaxLatencyP99, "DUSTS_MAX_LATENCY_P99")
+	overrideDuration(&c.Poller.MaxRecovery, "DUSTS_MAX_RECOVERY")
+
+	if c.FileServerGopathV0 == "" {
+		c.FileServerGopathV0 = c.Gopath("GOPATH_V0")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid env overrides: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Gopath returns the source checkout in the GOPATH env var name, or else
+// the one configured for it in the config file. GOPATH itself is set in most
+// Go environments, so a GOPATH in the config file takes priority over it.
+func (c suiteConfig) Gopath(name string) string {
+	if gopath, ok := c.Gopaths[name]; ok && name == "GOPATH" {
+		return gopath
+	}
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return c.Gopaths[name]
+}
+
+// Prebuilt returns the prebuilt executables in the env var name, or else
+// the ones configured for it in the config file.
+func (c suiteConfig) Prebuilt(name string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return c.PrebuiltBinaries[name]
+}
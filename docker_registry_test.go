@@ -0,0 +1,305 @@
+package dusts_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	archive_helper "code.cloudfoundry.org/archiver/extractor/test_helper"
+	"code.cloudfoundry.org/guardian/gqt/runner"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/http_server"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	dockerCanaryImage = "dusts/go-server"
+	dockerCanaryTag   = "latest"
+
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// writeGoServerImage writes an OCI image layout to layoutDir with a single
+// layer holding the files of the go-server fixture at the root of the image,
+// tagged dockerCanaryTag.
+func writeGoServerImage(layoutDir string, files []archive_helper.ArchiveFile) error {
+	layer := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(layer)
+	for _, file := range files {
+		err := tarWriter.WriteHeader(&tar.Header{Name: file.Name, Mode: 0755, Size: int64(len(file.Body))})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write([]byte(file.Body))
+		if err != nil {
+			return err
+		}
+	}
+	err := tarWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	compressed := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(compressed)
+	_, err = gzipWriter.Write(layer.Bytes())
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Entrypoint":   []string{"/go-server"},
+			"Env":          []string{"PATH=/"},
+			"ExposedPorts": map[string]struct{}{"8080/tcp": {}},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{sha256Digest(layer.Bytes())},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	configDescriptor, err := writeOCIBlob(layoutDir, ociConfigMediaType, config)
+	if err != nil {
+		return err
+	}
+	layerDescriptor, err := writeOCIBlob(layoutDir, ociLayerMediaType, compressed.Bytes())
+	if err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        configDescriptor,
+		Layers:        []ociDescriptor{layerDescriptor},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDescriptor, err := writeOCIBlob(layoutDir, ociManifestMediaType, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDescriptor.Annotations = map[string]string{ociRefNameAnnotation: dockerCanaryTag}
+
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{manifestDescriptor}})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(layoutDir, "index.json"), index, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(layoutDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+func writeOCIBlob(layoutDir, mediaType string, content []byte) (ociDescriptor, error) {
+	digest := sha256Digest(content)
+	blobsDir := filepath.Join(layoutDir, "blobs", "sha256")
+	err := os.MkdirAll(blobsDir, 0755)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	err = ioutil.WriteFile(filepath.Join(blobsDir, strings.TrimPrefix(digest, "sha256:")), content, 0644)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}, nil
+}
+
+func sha256Digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// ociRegistry is a read-only stand-in for a docker registry, serving the
+// image in an OCI image layout on disk through the parts of the registry v2
+// API that garden needs to pull it, so docker LRPs run without network
+// access.
+type ociRegistry struct {
+	layoutDir string
+	image     string
+}
+
+func newOCIRegistry(addr, layoutDir, image string) ifrit.Runner {
+	return http_server.New(addr, &ociRegistry{layoutDir: layoutDir, image: image})
+}
+
+func (r *ociRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if req.URL.Path == "/v2/" || req.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	prefix := "/v2/" + r.image + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		http.NotFound(w, req)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch parts[0] {
+	case "manifests":
+		descriptor, ok := r.manifest(parts[1])
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		r.serveBlob(w, req, descriptor.Digest, descriptor.MediaType)
+	case "blobs":
+		r.serveBlob(w, req, parts[1], "application/octet-stream")
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// manifest resolves a tag or digest against the index of the layout.
+func (r *ociRegistry) manifest(reference string) (ociDescriptor, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(r.layoutDir, "index.json"))
+	if err != nil {
+		return ociDescriptor{}, false
+	}
+	var index ociIndex
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return ociDescriptor{}, false
+	}
+
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest == reference || descriptor.Annotations[ociRefNameAnnotation] == reference {
+			return descriptor, true
+		}
+	}
+	return ociDescriptor{}, false
+}
+
+func (r *ociRegistry) serveBlob(w http.ResponseWriter, req *http.Request, digest, mediaType string) {
+	if !strings.HasPrefix(digest, "sha256:") || strings.ContainsAny(digest, "/.") {
+		http.NotFound(w, req)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(r.layoutDir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "GET" {
+		w.Write(content)
+	}
+}
+
+// trustRegistryInGrootFS makes the grootfs image plugins of garden pull
+// from registry over plain HTTP. Garden's own InsecureDockerRegistry does not
+// reach the image plugins, which read their insecure_registries from the
+// config file passed to them with --config, so a copy of that config with
+// the registry added is passed instead.
+func trustRegistryInGrootFS(cfg *runner.GdnRunnerConfig, registry string) error {
+	for _, args := range [][]string{cfg.ImagePluginExtraArgs, cfg.PrivilegedImagePluginExtraArgs} {
+		for i := 0; i+1 < len(args); i++ {
+			if strings.Trim(args[i], `"`) != "--config" {
+				continue
+			}
+
+			configPath := strings.Trim(args[i+1], `"`)
+			trustedPath, err := writeTrustingGrootFSConfig(configPath, registry)
+			if err != nil {
+				return err
+			}
+			args[i+1] = trustedPath
+		}
+	}
+	return nil
+}
+
+func writeTrustingGrootFSConfig(configPath, registry string) (string, error) {
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	var document interface{}
+	err = yaml.Unmarshal(contents, &document)
+	if err != nil {
+		return "", fmt.Errorf("parsing grootfs config %s: %s", configPath, err)
+	}
+	config, ok := jsonCompatible(document).(map[string]interface{})
+	if !ok {
+		config = map[string]interface{}{}
+	}
+
+	create, ok := config["create"].(map[string]interface{})
+	if !ok {
+		create = map[string]interface{}{}
+	}
+	registries, _ := create["insecure_registries"].([]interface{})
+	create["insecure_registries"] = append(registries, registry)
+	config["create"] = create
+
+	contents, err = yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	trustedPath := strings.TrimSuffix(configPath, filepath.Ext(configPath)) + "-dusts.yml"
+	err = ioutil.WriteFile(trustedPath, contents, 0644)
+	if err != nil {
+		return "", err
+	}
+	return trustedPath, nil
+}
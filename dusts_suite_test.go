@@ -3,8 +3,7 @@ package dusts_test
 import (
 	"fmt"
 	"os"
-	"path"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/bbs"
@@ -18,22 +17,22 @@ import (
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/config"
 	. "github.com/onsi/gomega"
-	"github.com/onsi/gomega/gexec"
 
 	"testing"
 )
 
-const (
-	diegoGAVersion            = "v1.0.0"
-	diegoLocketLocalREVersion = "v1.25.2"
-)
-
 var (
 	ComponentMakerV0, ComponentMakerV1 world.ComponentMaker
+	// IntermediateComponentMakers hold the releases between V0 and V1 when
+	// DIEGO_INTERMEDIATE_VERSIONS is set, in upgrade order.
+	IntermediateComponentMakers []world.ComponentMaker
 
-	componentLogs *os.File
+	componentLogs    *os.File
+	componentLogPath string
 
 	oldArtifacts, newArtifacts world.BuiltArtifacts
+	intermediateReleases       []*diegoRelease
+	intermediateArtifacts      []world.BuiltArtifacts
 	addresses                  world.ComponentAddresses
 	upgrader                   Upgrader
 
@@ -50,19 +49,112 @@ var (
 
 func TestDusts(t *testing.T) {
 	helpers.RegisterDefaultTimeouts()
-	RegisterFailHandler(Fail)
+	RegisterFailHandler(recordFailure)
 	RunSpecs(t, "Dusts Suite")
 }
 
 var _ = BeforeSuite(func() {
 	suiteTempDir = world.TempDir("before-suite")
 
-	if version := os.Getenv("DIEGO_VERSION_V0"); version != diegoGAVersion && version != diegoLocketLocalREVersion {
-		Fail("DIEGO_VERSION_V0 not set")
+	checks := &preflight{}
+	if suiteConfigErr != nil {
+		checks.problemf("%s", suiteConfigErr)
+	}
+	if v0ReleaseErr != nil {
+		checks.problemf("%s", v0ReleaseErr)
+	}
+	if upgradeOrdersErr != nil {
+		checks.problemf("DUSTS_UPGRADE_ORDERS: %s", upgradeOrdersErr)
 	}
+	if len(upgradeOrders) > 0 && suite.UpgradeOrders != "all" && suite.UpgradeOrderSeed == 0 && config.GinkgoConfig.ParallelTotal > 1 {
+		checks.problemf("DUSTS_UPGRADE_ORDER_SEED must be set to sample upgrade orders on parallel nodes, e.g. to %d", upgradeOrderSeed)
+	}
+	graceTarballChecksum = checks.require("GRACE_TARBALL_CHECKSUM", suite.GraceTarballChecksum)
+	checks.require("DEFAULT_ROOTFS", suite.DefaultRootFS)
 
-	if graceTarballChecksum = os.Getenv("GRACE_TARBALL_CHECKSUM"); graceTarballChecksum == "" {
-		Fail("GRACE_TARBALL_CHECKSUM not set")
+	var err error
+	intermediateReleases, err = lookupIntermediateReleases(suite.DiegoIntermediateVersions)
+	if err != nil {
+		checks.problemf("DIEGO_INTERMEDIATE_VERSIONS: %s", err)
+	}
+	v0Plans := []string{}
+	if v0Release != nil {
+		planPath := v0Release.UpgradePlan
+		if suite.UpgradePlan != "" {
+			planPath = suite.UpgradePlan
+		}
+		v0Plans = append([]string{planPath}, scenarioPlans()...)
+		err = v0Release.Validate(v0Plans...)
+		if err != nil {
+			checks.problemf("%s", err)
+		}
+	}
+	for _, release := range intermediateReleases {
+		err = release.Validate(release.UpgradePlan)
+		if err != nil {
+			checks.problemf("%s", err)
+		}
+	}
+
+	intermediateBinariesPaths := []string{}
+	jobs := []buildJob{}
+	if v0Release != nil {
+		jobs = append(jobs, releaseExecutableBuilds(v0Release, "/tmp/v0_binaries", "_V0")...)
+		if plansRun(componentFileServer, v0Plans...) {
+			jobs = append(jobs, fileServerBuild("/tmp/v0_binaries", suite.FileServerGopathV0))
+		}
+	}
+	for i, release := range intermediateReleases {
+		binariesPath := fmt.Sprintf("/tmp/%s_binaries", release.Version)
+		intermediateBinariesPaths = append(intermediateBinariesPaths, binariesPath)
+		envSuffix := fmt.Sprintf("_V%d", i+1)
+		jobs = append(jobs, releaseExecutableBuilds(release, binariesPath, envSuffix)...)
+		if plansRun(componentFileServer, release.UpgradePlan) {
+			jobs = append(jobs, fileServerBuild(binariesPath, suite.Gopath("FILE_SERVER_GOPATH"+envSuffix)))
+		}
+	}
+	jobs = append(jobs, testedExecutableBuildsV1()...)
+
+	prebuilt := map[string]world.BuiltExecutables{}
+	envSuffixes := map[string]string{"/tmp/v0_binaries": "_V0", "/tmp/v1_binaries": ""}
+	releases := map[string]string{}
+	if v0Release != nil {
+		releases["/tmp/v0_binaries"] = v0Release.Version
+	}
+	for i, binariesPath := range intermediateBinariesPaths {
+		envSuffixes[binariesPath] = fmt.Sprintf("_V%d", i+1)
+		releases[binariesPath] = intermediateReleases[i].Version
+	}
+	for binariesPath, envSuffix := range envSuffixes {
+		var executables world.BuiltExecutables
+		jobs, executables, err = usePrebuiltExecutables(jobs, binariesPath, envSuffix, releases[binariesPath])
+		if err != nil {
+			checks.problemf("%s", err)
+		}
+		if executables != nil {
+			prebuilt[binariesPath] = executables
+		}
+	}
+
+	checks.checkBuildJobs(jobs)
+	checks.checkVizzini("GOPATH")
+	checks.checkVizzini("GOPATH_V0")
+	checks.checkTool("go")
+	checks.checkTool("git")
+	checks.checkTool("ginkgo")
+	checks.checkGrootFSStore()
+	checks.checkDB()
+	Expect(checks.Err()).NotTo(HaveOccurred())
+
+	results, err := runBuilds(jobs, buildConcurrency())
+	printBuildTimes(results)
+	Expect(err).NotTo(HaveOccurred())
+
+	executablesIn := func(binariesPath string) world.BuiltExecutables {
+		if executables, ok := prebuilt[binariesPath]; ok {
+			return executables
+		}
+		return builtExecutables(results, binariesPath)
 	}
 
 	oldArtifacts = world.BuiltArtifacts{
@@ -71,7 +163,19 @@ var _ = BeforeSuite(func() {
 
 	oldArtifacts.Lifecycles.BuildLifecycles("dockerapplifecycle", suiteTempDir)
 	oldArtifacts.Lifecycles.BuildLifecycles("buildpackapplifecycle", suiteTempDir)
-	oldArtifacts.Executables = compileTestedExecutablesV0()
+	oldArtifacts.Executables = executablesIn("/tmp/v0_binaries")
+
+	intermediateArtifacts = nil
+	for _, binariesPath := range intermediateBinariesPaths {
+		artifacts := world.BuiltArtifacts{
+			Lifecycles: world.BuiltLifecycles{},
+		}
+
+		artifacts.Lifecycles.BuildLifecycles("dockerapplifecycle", suiteTempDir)
+		artifacts.Lifecycles.BuildLifecycles("buildpackapplifecycle", suiteTempDir)
+		artifacts.Executables = executablesIn(binariesPath)
+		intermediateArtifacts = append(intermediateArtifacts, artifacts)
+	}
 
 	newArtifacts = world.BuiltArtifacts{
 		Lifecycles: world.BuiltLifecycles{},
@@ -79,18 +183,32 @@ var _ = BeforeSuite(func() {
 
 	newArtifacts.Lifecycles.BuildLifecycles("dockerapplifecycle", suiteTempDir)
 	newArtifacts.Lifecycles.BuildLifecycles("buildpackapplifecycle", suiteTempDir)
-	newArtifacts.Executables = compileTestedExecutablesV1()
+	newArtifacts.Executables = executablesIn("/tmp/v1_binaries")
+
+	node := GinkgoParallelNode()
+	startPort := suite.Ports.RangeStride * node
+	endPort := startPort + suite.Ports.RangeSize
+
+	allocator, err = portauthority.New(startPort, endPort)
+	Expect(err).NotTo(HaveOccurred())
+
+	// The file server and the router are claimed from the allocator rather
+	// than offset from a fixed port, so that they cannot collide with the
+	// ports it hands out to the other components.
+	fileServerPort, err := allocator.ClaimPorts(1)
+	Expect(err).NotTo(HaveOccurred())
+	routerPort, err := allocator.ClaimPorts(1)
+	Expect(err).NotTo(HaveOccurred())
 
 	_, dbBaseConnectionString := world.DBInfo()
 
-	// TODO: the hard coded addresses for router and file server prevent running multiple dusts tests at the same time
 	addresses = world.ComponentAddresses{
 		Garden:              fmt.Sprintf("127.0.0.1:%d", 10000+config.GinkgoConfig.ParallelNode),
 		NATS:                fmt.Sprintf("127.0.0.1:%d", 11000+config.GinkgoConfig.ParallelNode),
 		Consul:              fmt.Sprintf("127.0.0.1:%d", 12750+config.GinkgoConfig.ParallelNode*consulrunner.PortOffsetLength),
 		Rep:                 fmt.Sprintf("127.0.0.1:%d", 14000+config.GinkgoConfig.ParallelNode),
-		FileServer:          fmt.Sprintf("127.0.0.1:%d", 8080),
-		Router:              fmt.Sprintf("127.0.0.1:%d", 80),
+		FileServer:          fmt.Sprintf("127.0.0.1:%d", fileServerPort),
+		Router:              fmt.Sprintf("127.0.0.1:%d", routerPort),
 		BBS:                 fmt.Sprintf("127.0.0.1:%d", 20500+config.GinkgoConfig.ParallelNode*2),
 		Health:              fmt.Sprintf("127.0.0.1:%d", 20500+config.GinkgoConfig.ParallelNode*2+1),
 		Auctioneer:          fmt.Sprintf("127.0.0.1:%d", 23000+config.GinkgoConfig.ParallelNode),
@@ -101,20 +219,12 @@ var _ = BeforeSuite(func() {
 		SQL:                 fmt.Sprintf("%sdiego_%d", dbBaseConnectionString, config.GinkgoConfig.ParallelNode),
 	}
 
-	node := GinkgoParallelNode()
-	startPort := 2000 * node
-	portRange := 5000
-	endPort := startPort + portRange
-
-	allocator, err := portauthority.New(startPort, endPort)
-	Expect(err).NotTo(HaveOccurred())
-
 	depotDir := world.TempDirWithParent(suiteTempDir, "depotDir")
 
 	certAuthority, err = certauthority.NewCertAuthority(depotDir, "ca")
 	Expect(err).NotTo(HaveOccurred())
 
-	componentLogPath := os.Getenv("DUSTS_COMPONENT_LOG_PATH")
+	componentLogPath = suite.ComponentLogPath
 	if componentLogPath == "" {
 		componentLogPath = fmt.Sprintf("dusts-component-logs.0.0.0.%d.log", time.Now().Unix())
 	}
@@ -122,6 +232,9 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	fmt.Printf("Writing component logs to %s\n", componentLogPath)
 
+	componentLogFiles, err = newComponentLogDir(strings.TrimSuffix(componentLogPath, ".log"))
+	Expect(err).NotTo(HaveOccurred())
+
 	ComponentMakerV1 = world.MakeComponentMaker(newArtifacts, addresses, allocator, certAuthority)
 	ComponentMakerV1.Setup()
 
@@ -144,6 +257,9 @@ var _ = AfterSuite(func() {
 	}
 
 	Expect(os.RemoveAll(suiteTempDir)).To(Succeed())
+	if componentLogFiles != nil {
+		componentLogFiles.Close()
+	}
 	componentLogs.Close()
 })
 
@@ -169,86 +285,96 @@ func QuietJustBeforeEach(f func()) {
 	})
 }
 
-func buildWithGopath(binariesPath, gopath, packagePath string, args ...string) string {
-	Expect(os.MkdirAll(binariesPath, 0777)).To(Succeed())
-	binaryName := filepath.Base(packagePath)
-	expectedBinaryPath := path.Join(binariesPath, binaryName)
-	cwd, err := os.Getwd()
-	Expect(err).To(Succeed())
-	if _, err := os.Stat(expectedBinaryPath); os.IsNotExist(err) {
-		fmt.Printf("Building %s with Gopath %s \n", packagePath, gopath)
-		Expect(os.Chdir(gopath)).To(Succeed())
-		binaryPath, err := gexec.BuildIn(gopath, packagePath, args...)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(os.Rename(binaryPath, path.Join(binariesPath, binaryName))).To(Succeed())
-		Expect(os.Chdir(cwd)).To(Succeed())
-	}
-	return expectedBinaryPath
-}
-
-func buildAsModule(binariesPath, modulepath, packagePath string, args ...string) string {
-	Expect(os.MkdirAll(binariesPath, 0777)).To(Succeed())
-	binaryName := filepath.Base(packagePath)
-	expectedBinaryPath := path.Join(binariesPath, binaryName)
-	cwd, err := os.Getwd()
-	Expect(err).To(Succeed())
-	if _, err := os.Stat(expectedBinaryPath); os.IsNotExist(err) {
-		fmt.Printf("Building %s as Module \n", packagePath)
-		Expect(os.Chdir(modulepath)).To(Succeed())
-		binaryPath, err := gexec.Build(packagePath, args...)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(os.Rename(binaryPath, path.Join(binariesPath, binaryName))).To(Succeed())
-		Expect(os.Chdir(cwd)).To(Succeed())
-	}
-	return expectedBinaryPath
-}
-
-func compileTestedExecutablesV1() world.BuiltExecutables {
+// testedExecutableBuildsV1 builds the executables under test as modules
+// from the checkouts in the *_GOPATH env vars.
+func testedExecutableBuildsV1() []buildJob {
 	binariesPath := "/tmp/v1_binaries"
-	builtExecutables := world.BuiltExecutables{}
-
-	builtExecutables["garden"] = buildAsModule(binariesPath, os.Getenv("GARDEN_GOPATH"), "./cmd/gdn", "-race", "-a", "-tags", "daemon")
-	builtExecutables["auctioneer"] = buildAsModule(binariesPath, os.Getenv("AUCTIONEER_GOPATH"), "code.cloudfoundry.org/auctioneer/cmd/auctioneer", "-race")
-	builtExecutables["rep"] = buildAsModule(binariesPath, os.Getenv("REP_GOPATH"), "code.cloudfoundry.org/rep/cmd/rep", "-race")
-	builtExecutables["bbs"] = buildAsModule(binariesPath, os.Getenv("BBS_GOPATH"), "code.cloudfoundry.org/bbs/cmd/bbs", "-race")
-	builtExecutables["locket"] = buildAsModule(binariesPath, os.Getenv("LOCKET_GOPATH"), "code.cloudfoundry.org/locket/cmd/locket", "-race")
-	builtExecutables["file-server"] = buildAsModule(binariesPath, os.Getenv("FILE_SERVER_GOPATH"), "code.cloudfoundry.org/fileserver/cmd/file-server", "-race")
-	builtExecutables["route-emitter"] = buildAsModule(binariesPath, os.Getenv("ROUTE_EMITTER_GOPATH"), "code.cloudfoundry.org/route-emitter/cmd/route-emitter", "-race")
-
-	Expect(os.Setenv("GO111MODULE", "auto")).To(Succeed())
-	builtExecutables["router"] = buildWithGopath(binariesPath, os.Getenv("ROUTER_GOPATH"), "code.cloudfoundry.org/gorouter", "-race")
-	builtExecutables["routing-api"] = buildAsModule(binariesPath, os.Getenv("ROUTING_API_GOPATH"), "code.cloudfoundry.org/routing-api/cmd/routing-api", "-race")
-	Expect(os.Setenv("GO111MODULE", "")).To(Succeed())
-
-	builtExecutables["ssh-proxy"] = buildAsModule(binariesPath, os.Getenv("SSH_PROXY_GOPATH"), "code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy", "-race")
-
-	os.Setenv("CGO_ENABLED", "0")
-	builtExecutables["sshd"] = buildAsModule(binariesPath, os.Getenv("SSHD_GOPATH"), "code.cloudfoundry.org/diego-ssh/cmd/sshd", "-a", "-installsuffix", "static")
-	os.Unsetenv("CGO_ENABLED")
+	module := func(executable, envVar, packagePath string, args ...string) buildJob {
+		return buildJob{
+			Executable:   executable,
+			BinariesPath: binariesPath,
+			SourceDir:    suite.Gopath(envVar),
+			Package:      packagePath,
+			Args:         args,
+		}
+	}
 
-	return builtExecutables
+	router := module("router", "ROUTER_GOPATH", "code.cloudfoundry.org/gorouter", "-race")
+	router.Gopath = true
+	routingAPI := module("routing-api", "ROUTING_API_GOPATH", "code.cloudfoundry.org/routing-api/cmd/routing-api", "-race")
+	routingAPI.Env = []string{"GO111MODULE=auto"}
+	sshd := module("sshd", "SSHD_GOPATH", "code.cloudfoundry.org/diego-ssh/cmd/sshd", "-a", "-installsuffix", "static")
+	sshd.Env = []string{"CGO_ENABLED=0"}
+
+	return []buildJob{
+		module("garden", "GARDEN_GOPATH", "./cmd/gdn", "-race", "-a", "-tags", "daemon"),
+		module("auctioneer", "AUCTIONEER_GOPATH", "code.cloudfoundry.org/auctioneer/cmd/auctioneer", "-race"),
+		module("rep", "REP_GOPATH", "code.cloudfoundry.org/rep/cmd/rep", "-race"),
+		module("bbs", "BBS_GOPATH", "code.cloudfoundry.org/bbs/cmd/bbs", "-race"),
+		module("locket", "LOCKET_GOPATH", "code.cloudfoundry.org/locket/cmd/locket", "-race"),
+		module("file-server", "FILE_SERVER_GOPATH", "code.cloudfoundry.org/fileserver/cmd/file-server", "-race"),
+		module("route-emitter", "ROUTE_EMITTER_GOPATH", "code.cloudfoundry.org/route-emitter/cmd/route-emitter", "-race"),
+		router,
+		routingAPI,
+		module("ssh-proxy", "SSH_PROXY_GOPATH", "code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy", "-race"),
+		sshd,
+	}
 }
 
-func compileTestedExecutablesV0() world.BuiltExecutables {
-	binariesPath := "/tmp/v0_binaries"
-	builtExecutables := world.BuiltExecutables{}
+// plansRun reports whether any of the upgrade plans at planPaths starts or
+// upgrades the component. Plans that cannot be loaded are reported by
+// diegoRelease.Validate.
+func plansRun(component string, planPaths ...string) bool {
+	for _, path := range planPaths {
+		plan, err := LoadUpgradePlan(path)
+		if err == nil && plan.Runs(component) {
+			return true
+		}
+	}
+	return false
+}
 
-	Expect(os.Setenv("GO111MODULE", "auto")).To(Succeed())
+// releaseExecutableBuilds builds the executables of an older release from
+// GOPATHs taken from env vars named with envSuffix, e.g. REP_GOPATH_V0.
+func releaseExecutableBuilds(release *diegoRelease, binariesPath, envSuffix string) []buildJob {
+	gopath := func(executable, envVar, packagePath string, args ...string) buildJob {
+		return buildJob{
+			Executable:   executable,
+			BinariesPath: binariesPath,
+			SourceDir:    suite.Gopath(envVar + envSuffix),
+			Package:      packagePath,
+			Args:         args,
+			Gopath:       true,
+		}
+	}
 
-	builtExecutables["auctioneer"] = buildWithGopath(binariesPath, os.Getenv("AUCTIONEER_GOPATH_V0"), "code.cloudfoundry.org/auctioneer/cmd/auctioneer", "-race")
-	builtExecutables["rep"] = buildWithGopath(binariesPath, os.Getenv("REP_GOPATH_V0"), "code.cloudfoundry.org/rep/cmd/rep", "-race")
-	builtExecutables["bbs"] = buildWithGopath(binariesPath, os.Getenv("BBS_GOPATH_V0"), "code.cloudfoundry.org/bbs/cmd/bbs", "-race")
-	builtExecutables["route-emitter"] = buildWithGopath(binariesPath, os.Getenv("ROUTE_EMITTER_GOPATH_V0"), "code.cloudfoundry.org/route-emitter/cmd/route-emitter", "-race")
-	builtExecutables["ssh-proxy"] = buildWithGopath(binariesPath, os.Getenv("SSH_PROXY_GOPATH_V0"), "code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy", "-race")
+	jobs := []buildJob{
+		gopath("auctioneer", "AUCTIONEER_GOPATH", "code.cloudfoundry.org/auctioneer/cmd/auctioneer", "-race"),
+		gopath("rep", "REP_GOPATH", "code.cloudfoundry.org/rep/cmd/rep", "-race"),
+		gopath("bbs", "BBS_GOPATH", "code.cloudfoundry.org/bbs/cmd/bbs", "-race"),
+		gopath("route-emitter", "ROUTE_EMITTER_GOPATH", "code.cloudfoundry.org/route-emitter/cmd/route-emitter", "-race"),
+		gopath("ssh-proxy", "SSH_PROXY_GOPATH", "code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy", "-race"),
+	}
 
-	if os.Getenv("DIEGO_VERSION_V0") == diegoLocketLocalREVersion {
-		builtExecutables["locket"] = buildWithGopath(binariesPath, os.Getenv("GOPATH_V0"), "code.cloudfoundry.org/locket/cmd/locket", "-race")
+	if release.HasLocket() {
+		jobs = append(jobs, gopath("locket", "GOPATH", "code.cloudfoundry.org/locket/cmd/locket", "-race"))
 	}
 
-	os.Setenv("CGO_ENABLED", "0")
-	builtExecutables["sshd"] = buildWithGopath(binariesPath, os.Getenv("SSHD_GOPATH_V0"), "code.cloudfoundry.org/diego-ssh/cmd/sshd", "-a", "-installsuffix", "static")
-	os.Unsetenv("CGO_ENABLED")
+	sshd := gopath("sshd", "SSHD_GOPATH", "code.cloudfoundry.org/diego-ssh/cmd/sshd", "-a", "-installsuffix", "static")
+	sshd.Env = []string{"CGO_ENABLED=0"}
+	return append(jobs, sshd)
+}
 
-	Expect(os.Setenv("GO111MODULE", "")).To(Succeed())
-	return builtExecutables
+// fileServerBuild builds the file server of an older release from a GOPATH.
+// Only the upgrade plans that start or upgrade a file server need one; the
+// others use the V1 file server of the plumbing.
+func fileServerBuild(binariesPath, gopath string) buildJob {
+	return buildJob{
+		Executable:   "file-server",
+		BinariesPath: binariesPath,
+		SourceDir:    gopath,
+		Package:      "code.cloudfoundry.org/fileserver/cmd/file-server",
+		Args:         []string{"-race"},
+		Gopath:       true,
+	}
 }
@@ -4,20 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
-	auctioneerconfig "code.cloudfoundry.org/auctioneer/cmd/auctioneer/config"
-	bbsconfig "code.cloudfoundry.org/bbs/cmd/bbs/config"
 	"code.cloudfoundry.org/guardian/gqt/runner"
 	"code.cloudfoundry.org/inigo/helpers"
 	"code.cloudfoundry.org/inigo/world"
-	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/localip"
-	repconfig "code.cloudfoundry.org/rep/cmd/rep/config"
 	routeemitterconfig "code.cloudfoundry.org/route-emitter/cmd/route-emitter/config"
 	vizziniconfig "code.cloudfoundry.org/vizzini/config"
 	. "github.com/onsi/ginkgo"
@@ -27,47 +26,12 @@ import (
 	"github.com/tedsuo/ifrit/grouper"
 )
 
-var (
-	repV0UnsupportedVizziniTests = []string{"MaxPids", "CF_INSTANCE_INTERNAL_IP", "sidecar"}
-	// security_group_tests in V0 vizzini won't pass since they try to access the
-	// router (as opposed to www.example.com in recent versions). Security groups
-	// don't affect access to the host machine, therefore they cannot block
-	// traffic which causes both tests in that file to fail
-	securityGroupV0Tests = "should allow access to an internal IP"
-
-	vizziniConfigFile *os.File
-)
+var vizziniConfigFile *os.File
 
 var _ = Describe("UpgradeVizzini", func() {
-	disableAuctioneerSSL := func(cfg *auctioneerconfig.AuctioneerConfig) {
-		cfg.CACertFile = ""
-		cfg.ServerCertFile = ""
-		cfg.ServerKeyFile = ""
-	}
-	skipLocketForBBS := func(cfg *bbsconfig.BBSConfig) {
-		cfg.LocksLocketEnabled = false
-		cfg.CellRegistrationsLocketEnabled = false
-	}
-	fallbackToHTTPAuctioneer := func(cfg *bbsconfig.BBSConfig) {
-		cfg.AuctioneerRequireTLS = false
-	}
-	disableLocketForAuctioneer := func(cfg *auctioneerconfig.AuctioneerConfig) {
-		cfg.LocksLocketEnabled = false
-	}
-	exportNetworkConfigs := func(cfg *repconfig.RepConfig) {
-		cfg.ExportNetworkEnvVars = true
-	}
 	var (
-		plumbing                                             ifrit.Process
-		locket, bbs, routeEmitter, sshProxy, auctioneer, rep ifrit.Process
-		locketRunner                                         ifrit.Runner
-		bbsRunner                                            ifrit.Runner
-		routeEmitterRunner                                   ifrit.Runner
-		sshProxyRunner                                       ifrit.Runner
-		auctioneerRunner                                     ifrit.Runner
-		repRunner                                            ifrit.Runner
-		bbsClientGoPathEnvVar                                string
-		setRouteEmitterCellID                                func(config *routeemitterconfig.RouteEmitterConfig)
+		plumbing  ifrit.Process
+		processes []ifrit.Process
 	)
 
 	BeforeEach(func() {
@@ -81,304 +45,134 @@ var _ = Describe("UpgradeVizzini", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
-	if os.Getenv("DIEGO_VERSION_V0") == diegoGAVersion {
-		Context(fmt.Sprintf("from %s", diegoGAVersion), func() {
-			QuietBeforeEach(func() {
-				logger = lager.NewLogger("test")
-				logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.DEBUG))
-
-				bbsClientGoPathEnvVar = "GOPATH_V0"
-
-				ComponentMakerV0 = world.MakeV0ComponentMaker(oldArtifacts, addresses, allocator, certAuthority)
-				ComponentMakerV0.Setup()
-
-				fileServer, _ := ComponentMakerV1.FileServer()
-
-				plumbing = ginkgomon.Invoke(grouper.NewParallel(os.Kill, grouper.Members{
-					{Name: "nats", Runner: ComponentMakerV1.NATS()},
-					{Name: "sql", Runner: ComponentMakerV1.SQL()},
-					{Name: "consul", Runner: ComponentMakerV1.Consul()},
-					{Name: "file-server", Runner: fileServer},
-					{Name: "garden", Runner: ComponentMakerV1.Garden(func(cfg *runner.GdnRunnerConfig) {
-						poolSize := 100
-						cfg.PortPoolSize = &poolSize
-					})},
-					{Name: "router", Runner: ComponentMakerV1.Router()},
-				}))
-				helpers.ConsulWaitUntilReady(ComponentMakerV0.Addresses())
-
-				bbsRunner = ComponentMakerV0.BBS()
-				routeEmitterRunner = ComponentMakerV0.RouteEmitter()
-				auctioneerRunner = ComponentMakerV0.Auctioneer()
-				repRunner = ComponentMakerV0.Rep()
-				sshProxyRunner = ComponentMakerV0.SSHProxy()
-			})
-
-			QuietJustBeforeEach(func() {
-				bbs = ginkgomon.Invoke(bbsRunner)
-				routeEmitter = ginkgomon.Invoke(routeEmitterRunner)
-				auctioneer = ginkgomon.Invoke(auctioneerRunner)
-				rep = ginkgomon.Invoke(repRunner)
-				sshProxy = ginkgomon.Invoke(sshProxyRunner)
-			})
-
-			AfterEach(func() {
-				destroyContainerErrors := helpers.CleanupGarden(ComponentMakerV1.GardenClient())
-
-				helpers.StopProcesses(
-					auctioneer,
-					rep,
-					routeEmitter,
-					sshProxy,
-					bbs,
-					plumbing,
-				)
-
-				Expect(destroyContainerErrors).To(
-					BeEmpty(),
-					"%d containers failed to be destroyed!",
-					len(destroyContainerErrors),
-				)
-			})
-
-			Context("v0 configuration", func() {
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV0.BBSSSLConfig(), bbsClientGoPathEnvVar, securityGroupV0Tests)
-				})
-			})
-
-			Context("upgrading the BBS API", func() {
-				BeforeEach(func() {
-					bbsRunner = ComponentMakerV1.BBS(skipLocketForBBS, fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV0.Auctioneer(disableAuctioneerSSL)
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-				})
-
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, securityGroupV0Tests)
-				})
-			})
-
-			Context("upgrading the BBS API and BBS client", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-
-					bbsRunner = ComponentMakerV1.BBS(skipLocketForBBS, fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV0.Auctioneer(disableAuctioneerSSL)
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-				})
-
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, repV0UnsupportedVizziniTests...)
-				})
-			})
-
-			Context("upgrading the BBS API, BBS client, sshProxy, and Auctioneer", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-					bbsRunner = ComponentMakerV1.BBS(skipLocketForBBS, fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV1.Auctioneer(disableLocketForAuctioneer, disableAuctioneerSSL)
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-				})
-
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, repV0UnsupportedVizziniTests...)
-				})
-			})
-
-			Context("upgrading the BBS API, BBS client, sshProxy, Auctioneer, and Rep", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-					bbsRunner = ComponentMakerV1.BBS(skipLocketForBBS, fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV1.Auctioneer(disableLocketForAuctioneer, disableAuctioneerSSL)
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-					repRunner = ComponentMakerV1.Rep(exportNetworkConfigs)
-				})
-
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar)
-				})
-			})
-
-			Context("upgrading the BBS API, BBS client, sshProxy, Auctioneer, Rep, and Route Emitter", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-					bbsRunner = ComponentMakerV1.BBS(skipLocketForBBS, fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV1.Auctioneer(disableLocketForAuctioneer)
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-					repRunner = ComponentMakerV1.Rep(exportNetworkConfigs)
-					routeEmitterRunner = ComponentMakerV1.RouteEmitter()
-				})
+	if v0Release == nil {
+		return
+	}
 
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar)
-				})
-			})
+	Context(fmt.Sprintf("from %s", v0Release.Version), func() {
+		QuietBeforeEach(func() {
+			ComponentMakerV0 = v0Release.MakeComponentMaker(oldArtifacts, addresses, allocator, certAuthority)
+			ComponentMakerV0.Setup()
+
+			fileServer, _ := ComponentMakerV1.FileServer()
+
+			plumbing = ginkgomon.Invoke(grouper.NewParallel(os.Kill, grouper.Members{
+				{Name: "nats", Runner: ComponentMakerV1.NATS()},
+				{Name: "sql", Runner: ComponentMakerV1.SQL()},
+				{Name: "consul", Runner: ComponentMakerV1.Consul()},
+				{Name: "file-server", Runner: fileServer},
+				{Name: "garden", Runner: ComponentMakerV1.Garden(func(cfg *runner.GdnRunnerConfig) {
+					poolSize := 100
+					cfg.PortPoolSize = &poolSize
+				})},
+				{Name: "router", Runner: ComponentMakerV1.Router()},
+			}))
+			helpers.ConsulWaitUntilReady(ComponentMakerV0.Addresses())
 		})
-	} else if os.Getenv("DIEGO_VERSION_V0") == diegoLocketLocalREVersion {
-		Context(fmt.Sprintf("from %s", diegoLocketLocalREVersion), func() {
-			QuietBeforeEach(func() {
-				logger = lager.NewLogger("test")
-				logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.DEBUG))
-
-				bbsClientGoPathEnvVar = "GOPATH_V0"
-
-				ComponentMakerV0 = world.MakeComponentMaker(oldArtifacts, addresses, allocator, certAuthority)
-				ComponentMakerV0.Setup()
-
-				fileServer, _ := ComponentMakerV1.FileServer()
-
-				plumbing = ginkgomon.Invoke(grouper.NewParallel(os.Kill, grouper.Members{
-					{Name: "nats", Runner: ComponentMakerV1.NATS()},
-					{Name: "sql", Runner: ComponentMakerV1.SQL()},
-					{Name: "consul", Runner: ComponentMakerV1.Consul()},
-					{Name: "file-server", Runner: fileServer},
-					{Name: "garden", Runner: ComponentMakerV1.Garden(func(cfg *runner.GdnRunnerConfig) {
-						poolSize := 100
-						cfg.PortPoolSize = &poolSize
-					})},
-					{Name: "router", Runner: ComponentMakerV1.Router()},
-				}))
-				helpers.ConsulWaitUntilReady(ComponentMakerV0.Addresses())
-
-				locketRunner = ComponentMakerV0.Locket()
-				bbsRunner = ComponentMakerV0.BBS()
-				setRouteEmitterCellID = func(config *routeemitterconfig.RouteEmitterConfig) {
-					config.CellID = "the-cell-id-" + strconv.Itoa(GinkgoParallelNode()) + "-" + strconv.Itoa(0)
-				}
-				routeEmitterRunner = ComponentMakerV0.RouteEmitterN(0, setRouteEmitterCellID)
-				auctioneerRunner = ComponentMakerV0.Auctioneer()
-				repRunner = ComponentMakerV0.Rep(func(cfg *repconfig.RepConfig) {
-					cfg.ExportNetworkEnvVars = true
-				})
-				sshProxyRunner = ComponentMakerV0.SSHProxy()
-			})
-
-			QuietJustBeforeEach(func() {
-				locket = ginkgomon.Invoke(locketRunner)
-				bbs = ginkgomon.Invoke(bbsRunner)
-				routeEmitter = ginkgomon.Invoke(routeEmitterRunner)
-				auctioneer = ginkgomon.Invoke(auctioneerRunner)
-				rep = ginkgomon.Invoke(repRunner)
-				sshProxy = ginkgomon.Invoke(sshProxyRunner)
-			})
 
-			AfterEach(func() {
-				destroyContainerErrors := helpers.CleanupGarden(ComponentMakerV1.GardenClient())
-
-				helpers.StopProcesses(
-					auctioneer,
-					rep,
-					routeEmitter,
-					sshProxy,
-					bbs,
-					locket,
-					plumbing,
-				)
-
-				Expect(destroyContainerErrors).To(
-					BeEmpty(),
-					"%d containers failed to be destroyed!",
-					len(destroyContainerErrors),
-				)
-			})
+		AfterEach(func() {
+			destroyContainerErrors := helpers.CleanupGarden(ComponentMakerV1.GardenClient())
 
-			Context("v0 configuration", func() {
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV0.BBSSSLConfig(), bbsClientGoPathEnvVar, securityGroupV0Tests)
-				})
-			})
-
-			Context("upgrading the Locket API", func() {
-				BeforeEach(func() {
-					locketRunner = ComponentMakerV1.Locket()
-				})
+			for i := len(processes) - 1; i >= 0; i-- {
+				helpers.StopProcesses(processes[i])
+			}
+			processes = nil
+			helpers.StopProcesses(plumbing)
 
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV0.BBSSSLConfig(), bbsClientGoPathEnvVar, securityGroupV0Tests)
-				})
-			})
+			Expect(destroyContainerErrors).To(
+				BeEmpty(),
+				"%d containers failed to be destroyed!",
+				len(destroyContainerErrors),
+			)
+		})
 
-			Context("upgrading the BBS API", func() {
-				BeforeEach(func() {
-					bbsRunner = ComponentMakerV1.BBS(fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV0.Auctioneer(disableAuctioneerSSL)
-				})
+		for _, stage := range v0Release.VizziniStages {
+			stage := stage
 
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, securityGroupV0Tests)
-				})
-			})
-
-			Context("upgrading the Locket and BBS API", func() {
-				BeforeEach(func() {
-					locketRunner = ComponentMakerV1.Locket()
-					bbsRunner = ComponentMakerV1.BBS(fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV0.Auctioneer(disableAuctioneerSSL)
+			Context(stage.Name, func() {
+				QuietJustBeforeEach(func() {
+					for _, component := range v0Release.Components {
+						if component == componentFileServer {
+							continue
+						}
+						processes = append(processes, invokeVizziniComponent(stage, component))
+					}
 				})
 
 				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, securityGroupV0Tests)
-				})
-			})
-
-			Context("upgrading the Locket, BBS API and BBS client", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-					locketRunner = ComponentMakerV1.Locket()
-					bbsRunner = ComponentMakerV1.BBS(fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV0.Auctioneer(disableAuctioneerSSL)
-				})
+					sslConfig := ComponentMakerV0.BBSSSLConfig()
+					if stage.Upgrades(componentBBS) {
+						sslConfig = ComponentMakerV1.BBSSSLConfig()
+					}
 
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, repV0UnsupportedVizziniTests...)
-				})
-			})
+					gopathEnvVar := "GOPATH_V0"
+					if stage.V1BBSClient {
+						gopathEnvVar = "GOPATH"
+					}
 
-			Context("upgrading the Locket, BBS API, BBS client, sshProxy, and Auctioneer", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-					locketRunner = ComponentMakerV1.Locket()
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-					bbsRunner = ComponentMakerV1.BBS(fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV1.Auctioneer(disableLocketForAuctioneer)
-				})
+					skips := v0Release.UnsupportedVizziniTests
+					if stage.Upgrades(componentRep) {
+						skips = nil
+					} else if stage.V1BBSClient {
+						skips = v0Release.UnsupportedVizziniTestsWithV0Rep
+					}
 
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar, repV0UnsupportedVizziniTests...)
+					runVizziniTests(sslConfig, gopathEnvVar, skips...)
 				})
 			})
+		}
+	})
+})
 
-			Context("upgrading the Locket, BBS API, BBS client, sshProxy, Auctioneer, and Rep", func() {
-				BeforeEach(func() {
-					bbsClientGoPathEnvVar = "GOPATH"
-					fallbackToHTTPAuctioneer := func(cfg *bbsconfig.BBSConfig) {
-						cfg.AuctioneerRequireTLS = false
-					}
-					locketRunner = ComponentMakerV1.Locket()
-					bbsRunner = ComponentMakerV1.BBS(fallbackToHTTPAuctioneer)
-					auctioneerRunner = ComponentMakerV1.Auctioneer(disableLocketForAuctioneer)
-					sshProxyRunner = ComponentMakerV1.SSHProxy()
-					repRunner = ComponentMakerV1.Rep(exportNetworkConfigs)
-					routeEmitterRunner = ComponentMakerV1.RouteEmitterN(0, setRouteEmitterCellID)
-				})
+// invokeVizziniComponent starts the V0 or V1 version of component, as stage
+// says, with the mutators the stage names for it. Its output goes to the log
+// file of its version like in the RollingUpgrade specs.
+func invokeVizziniComponent(stage vizziniStage, component string) ifrit.Process {
+	mutators, err := resolveMutators(component, stage.Mutators[component])
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	generation := 0
+	maker := ComponentMakerV0
+	if stage.Upgrades(component) {
+		generation = len(intermediateReleases) + 1
+		maker = ComponentMakerV1
+	}
 
-				It("runs vizzini successfully", func() {
-					runVizziniTests(ComponentMakerV1.BBSSSLConfig(), bbsClientGoPathEnvVar)
-				})
-			})
-		})
+	var runner ifrit.Runner
+	switch component {
+	case componentLocket:
+		runner = maker.Locket(mutators.locket...)
+	case componentBBS:
+		runner = maker.BBS(mutators.bbs...)
+	case componentAuctioneer:
+		runner = maker.Auctioneer(mutators.auctioneer...)
+	case componentRouteEmitter:
+		runner = maker.RouteEmitter(mutators.routeEmitter...)
+	case componentLocalRouteEmitter:
+		setCellID := func(cfg *routeemitterconfig.RouteEmitterConfig) {
+			cfg.CellID = "the-cell-id-" + strconv.Itoa(GinkgoParallelNode()) + "-" + strconv.Itoa(0)
+		}
+		runner = maker.RouteEmitterN(0, append(mutators.routeEmitter, setCellID)...)
+	case componentRep:
+		runner = maker.Rep(mutators.rep...)
+	case componentSSHProxy:
+		runner = maker.SSHProxy(mutators.sshProxy...)
+	default:
+		recordFailure(fmt.Sprintf("vizzini cannot run %q", component))
+		return nil
 	}
-})
+
+	return componentLogFiles.Invoke(component, 0, generation, runner, ginkgomon.Invoke)
+}
 
 func runVizziniTests(sslConfig world.SSLConfig, gopathEnvVar string, skips ...string) {
 	ip, err := localip.LocalIP()
 	Expect(err).NotTo(HaveOccurred())
 
-	vizziniPath := filepath.Join(os.Getenv(gopathEnvVar), "src/code.cloudfoundry.org/vizzini")
-	defaultRootFS := os.Getenv("DEFAULT_ROOTFS")
+	vizziniPath := filepath.Join(suite.Gopath(gopathEnvVar), "src/code.cloudfoundry.org/vizzini")
+	defaultRootFS := suite.DefaultRootFS
 	flags := []string{
-		"-nodes", "4",
+		"-nodes", strconv.Itoa(suite.VizziniNodes),
 		"-randomizeAllSpecs",
 		"-r",
 		"-slowSpecThreshold", "60",
@@ -391,7 +185,7 @@ func runVizziniTests(sslConfig world.SSLConfig, gopathEnvVar string, skips ...st
 		BBSClientKeyPath:               sslConfig.ClientKey,
 		SSHAddress:                     ComponentMakerV1.Addresses().SSHProxy,
 		SSHPassword:                    "",
-		RoutableDomainSuffix:           "test.internal", // Served by dnsmasq using setup_inigo script
+		RoutableDomainSuffix:           "test.internal", // Routed through the router with HTTP_PROXY below
 		HostAddress:                    ip,
 		EnableDeclarativeHealthcheck:   false,
 		EnableContainerProxyTests:      false,
@@ -399,7 +193,7 @@ func runVizziniTests(sslConfig world.SSLConfig, gopathEnvVar string, skips ...st
 		RepPlacementTags:               []string{},
 		MaxTaskRetries:                 0,
 		DefaultRootFS:                  defaultRootFS,
-		GraceTarballURL:                "https://storage.googleapis.com/diego-assets-bucket/grace.tar.gz",
+		GraceTarballURL:                suite.GraceTarballURL,
 		GraceTarballChecksum:           graceTarballChecksum,
 		GraceBusyboxImageURL:           "docker:///cfdiegodocker/grace",
 		FileServerAddress:              "http://" + ComponentMakerV1.Addresses().FileServer,
@@ -414,11 +208,19 @@ func runVizziniTests(sslConfig world.SSLConfig, gopathEnvVar string, skips ...st
 	err = vizziniConfigFile.Close()
 	Expect(err).ToNot(HaveOccurred())
 
+	// The router no longer listens on port 80, so vizzini reaches it as an HTTP
+	// proxy: requests for *.test.internal are sent to the router, which routes
+	// them by their Host header.
+	routerProxy := "http://" + ComponentMakerV1.Addresses().Router
+	Expect(checkRouterProxy(routerProxy)).To(Succeed())
+
 	env := append(
 		os.Environ(),
-		fmt.Sprintf("GOPATH=%s", os.Getenv(gopathEnvVar)),
+		fmt.Sprintf("GOPATH=%s", suite.Gopath(gopathEnvVar)),
 		fmt.Sprintf("VIZZINI_CONFIG_PATH=%s", vizziniConfigFile.Name()),
 		"GO111MODULE=auto",
+		fmt.Sprintf("HTTP_PROXY=%s", routerProxy),
+		fmt.Sprintf("NO_PROXY=localhost,127.0.0.1,%s", ip),
 	)
 
 	cmd := exec.Command("ginkgo", flags...)
@@ -429,3 +231,28 @@ func runVizziniTests(sslConfig world.SSLConfig, gopathEnvVar string, skips ...st
 
 	Expect(cmd.Run()).To(Succeed())
 }
+
+// checkRouterProxy checks that a request for an unknown *.test.internal host
+// sent through proxy is answered by the router, the way vizzini sends its
+// requests with HTTP_PROXY set.
+func checkRouterProxy(proxy string) error {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get("http://dusts-proxy-check.test.internal/")
+	if err != nil {
+		return fmt.Errorf("vizzini cannot reach the router through HTTP_PROXY=%s: %s", proxy, err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Cf-Routererror") == "" {
+		return fmt.Errorf("HTTP_PROXY=%s answered with %s, not the router", proxy, resp.Status)
+	}
+	return nil
+}
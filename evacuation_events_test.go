@@ -0,0 +1,180 @@
+package dusts_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/events"
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeEventSource hands out the events sent to it until it is closed.
+type fakeEventSource struct {
+	events chan models.Event
+	closed chan struct{}
+}
+
+func newFakeEventSource() *fakeEventSource {
+	return &fakeEventSource{events: make(chan models.Event, 16), closed: make(chan struct{})}
+}
+
+func (s *fakeEventSource) Next() (models.Event, error) {
+	select {
+	case event := <-s.events:
+		return event, nil
+	case <-s.closed:
+		return nil, events.ErrSourceClosed
+	}
+}
+
+func (s *fakeEventSource) Close() error {
+	close(s.closed)
+	return nil
+}
+
+var _ = Describe("evacuationWatcher", func() {
+	var (
+		savedBBSClient          bbs.InternalClient
+		savedReplacementTimeout time.Duration
+		source                  *fakeEventSource
+		watcher                 *evacuationWatcher
+	)
+
+	lrpKey := models.NewActualLRPKey("large-canary", 0, "dusts")
+
+	running := func(cellID string, presence models.ActualLRP_Presence) *models.ActualLRP {
+		return &models.ActualLRP{
+			ActualLRPKey:         lrpKey,
+			ActualLRPInstanceKey: models.NewActualLRPInstanceKey("instance-"+cellID, cellID),
+			State:                models.ActualLRPStateRunning,
+			Presence:             presence,
+		}
+	}
+
+	changed := func(before, after models.ActualLRPInfo, instanceKey models.ActualLRPInstanceKey) *models.ActualLRPInstanceChangedEvent {
+		return &models.ActualLRPInstanceChangedEvent{
+			ActualLRPKey:         lrpKey,
+			ActualLRPInstanceKey: instanceKey,
+			Before:               &before,
+			After:                &after,
+		}
+	}
+
+	// evacuate sends the events of the BBS moving the instance on cell-0 to
+	// an evacuating copy and unclaiming the ordinary one.
+	evacuate := func() {
+		source.events <- &models.ActualLRPInstanceCreatedEvent{ActualLrp: running("cell-0", models.ActualLRP_Evacuating)}
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateRunning},
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed},
+			models.ActualLRPInstanceKey{},
+		)
+	}
+
+	// removeEvacuating sends the removal of the evacuating copy, when the rep
+	// of cell-0 exits.
+	removeEvacuating := func() {
+		source.events <- &models.ActualLRPInstanceRemovedEvent{ActualLrp: running("cell-0", models.ActualLRP_Evacuating)}
+	}
+
+	BeforeEach(func() {
+		savedBBSClient = bbsClient
+		savedReplacementTimeout = replacementTimeout
+		replacementTimeout = 200 * time.Millisecond
+
+		source = newFakeEventSource()
+		fakeBBS := &fake_bbs.FakeInternalClient{}
+		fakeBBS.SubscribeToInstanceEventsReturns(source, nil)
+		fakeBBS.ActualLRPsReturns([]*models.ActualLRP{running("cell-0", models.ActualLRP_Ordinary)}, nil)
+		bbsClient = fakeBBS
+
+		var err error
+		watcher, err = watchEvacuation([]string{"cell-0"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		bbsClient = savedBBSClient
+		replacementTimeout = savedReplacementTimeout
+	})
+
+	// eventually waits for the watcher to have seen every event sent.
+	eventually := func() {
+		Eventually(func() int { return len(source.events) }).Should(BeZero())
+	}
+
+	It("accepts an instance replaced on another cell", func() {
+		evacuate()
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed},
+			models.ActualLRPInfo{State: models.ActualLRPStateClaimed},
+			models.NewActualLRPInstanceKey("instance-cell-1", "cell-1"),
+		)
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateClaimed},
+			models.ActualLRPInfo{State: models.ActualLRPStateRunning},
+			models.NewActualLRPInstanceKey("instance-cell-1", "cell-1"),
+		)
+		removeEvacuating()
+		eventually()
+
+		Expect(watcher.Stop()).To(Succeed())
+	})
+
+	It("exempts an instance whose replacement cannot be placed", func() {
+		evacuate()
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed},
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed, PlacementError: "found no compatible cell"},
+			models.ActualLRPInstanceKey{},
+		)
+		removeEvacuating()
+		eventually()
+
+		start := time.Now()
+		Expect(watcher.Stop()).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", replacementTimeout))
+	})
+
+	It("still requires an unplaceable instance to have been EVACUATING", func() {
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateRunning},
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed, PlacementError: "found no compatible cell"},
+			models.ActualLRPInstanceKey{},
+		)
+		eventually()
+
+		err := watcher.Stop()
+		Expect(err).To(MatchError(ContainSubstring("large-canary/0 was never EVACUATING on cell-0")))
+		Expect(err).NotTo(MatchError(ContainSubstring("has no RUNNING replacement")))
+	})
+
+	It("fails an instance left UNCLAIMED without a placement error", func() {
+		evacuate()
+		removeEvacuating()
+		eventually()
+
+		Expect(watcher.Stop()).To(MatchError(ContainSubstring("large-canary/0 has no RUNNING replacement on another cell")))
+	})
+
+	It("fails an instance placed again after a placement error but never RUNNING", func() {
+		evacuate()
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed},
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed, PlacementError: "found no compatible cell"},
+			models.ActualLRPInstanceKey{},
+		)
+		source.events <- changed(
+			models.ActualLRPInfo{State: models.ActualLRPStateUnclaimed, PlacementError: "found no compatible cell"},
+			models.ActualLRPInfo{State: models.ActualLRPStateClaimed},
+			models.NewActualLRPInstanceKey("instance-cell-1", "cell-1"),
+		)
+		removeEvacuating()
+		eventually()
+
+		Expect(watcher.Stop()).To(MatchError(ContainSubstring("large-canary/0 has no RUNNING replacement on another cell")))
+	})
+})
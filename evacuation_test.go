@@ -0,0 +1,158 @@
+package dusts_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bbs/models"
+	repconfig "code.cloudfoundry.org/rep/cmd/rep/config"
+	. "github.com/onsi/ginkgo"
+	"github.com/tedsuo/ifrit"
+)
+
+var (
+	// evacuationGracePeriod is how long after its evacuation timeout a rep
+	// may take to exit before the evacuation is considered stuck.
+	evacuationGracePeriod  = 30 * time.Second
+	evacuationPollInterval = time.Second
+)
+
+var evacuationHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// repInstance is what the upgrader learns about a rep from the config its
+// ComponentMaker generated.
+type repInstance struct {
+	CellID string
+	// AdminAddr is the localhost-only listener serving /ping and /evacuate.
+	AdminAddr         string
+	EvacuationTimeout time.Duration
+}
+
+func newRepInstance(cfg *repconfig.RepConfig) repInstance {
+	return repInstance{
+		CellID:            cfg.CellID,
+		AdminAddr:         cfg.ListenAddr,
+		EvacuationTimeout: time.Duration(cfg.EvacuationTimeout),
+	}
+}
+
+// startEvacuation asks the rep to evacuate. The rep accepts the request and
+// evacuates in the background, exiting once it is done.
+func startEvacuation(rep repInstance) error {
+	if rep.AdminAddr == "" {
+		return fmt.Errorf("no admin address known for the rep of %s", rep.CellID)
+	}
+
+	resp, err := evacuationHTTPClient.Post("http://"+rep.AdminAddr+"/evacuate", "", nil)
+	if err != nil {
+		return fmt.Errorf("requesting evacuation of %s: %s", rep.CellID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("rep of %s refused to evacuate: %s %s", rep.CellID, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// evacuatingCell is a rep that was asked to evacuate.
+type evacuatingCell struct {
+	repInstance
+	Name    string
+	Process ifrit.Process
+}
+
+// waitForEvacuation waits for every rep to exit while polling the BBS for the
+// ActualLRPs still on their cells. It gives up once the longest evacuation
+// timeout plus evacuationGracePeriod has passed, listing the instances that
+// were left on each cell.
+func waitForEvacuation(cells []evacuatingCell) error {
+	timeout := time.Duration(suite.EvacuationTimeout)
+	for _, cell := range cells {
+		if cell.EvacuationTimeout > timeout {
+			timeout = cell.EvacuationTimeout
+		}
+	}
+	deadline := time.Now().Add(timeout + evacuationGracePeriod)
+
+	pending := map[string]evacuatingCell{}
+	for _, cell := range cells {
+		pending[cell.Name] = cell
+	}
+	remaining := map[string]string{}
+
+	ticker := time.NewTicker(evacuationPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for name, cell := range pending {
+			select {
+			case <-cell.Process.Wait():
+				fmt.Fprintf(GinkgoWriter, "%s (%s) finished evacuating\n", name, cell.CellID)
+				delete(pending, name)
+				delete(remaining, name)
+			default:
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return evacuationTimeoutError(timeout+evacuationGracePeriod, pending, remaining)
+		}
+
+		for name, cell := range pending {
+			left := describeActualLRPsOnCell(cell.CellID)
+			if left != remaining[name] {
+				fmt.Fprintf(GinkgoWriter, "%s (%s) evacuating: %s\n", name, cell.CellID, left)
+				remaining[name] = left
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// describeActualLRPsOnCell lists the ActualLRPs the BBS still places on the
+// cell, e.g. "2 instances: guid/0 RUNNING EVACUATING, guid/1 CLAIMED".
+func describeActualLRPsOnCell(cellID string) string {
+	lrps, err := bbsClient.ActualLRPs(logger, models.ActualLRPFilter{CellID: cellID})
+	if err != nil {
+		return fmt.Sprintf("failed to fetch ActualLRPs: %s", err)
+	}
+	if len(lrps) == 0 {
+		return "no instances"
+	}
+
+	instances := []string{}
+	for _, lrp := range lrps {
+		instance := fmt.Sprintf("%s/%d %s", lrp.ProcessGuid, lrp.Index, lrp.State)
+		if lrp.Presence == models.ActualLRP_Evacuating {
+			instance += " EVACUATING"
+		}
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+
+	return fmt.Sprintf("%d instances: %s", len(instances), strings.Join(instances, ", "))
+}
+
+func evacuationTimeoutError(timeout time.Duration, pending map[string]evacuatingCell, remaining map[string]string) error {
+	lines := []string{}
+	for name, cell := range pending {
+		left, ok := remaining[name]
+		if !ok {
+			left = describeActualLRPsOnCell(cell.CellID)
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", name, cell.CellID, left))
+	}
+	sort.Strings(lines)
+
+	return fmt.Errorf("reps did not finish evacuating within %s:\n  %s", timeout, strings.Join(lines, "\n  "))
+}
@@ -0,0 +1,136 @@
+package dusts_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/durationjson"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("evacuation", func() {
+	DescribeTable("startEvacuation",
+		func(status int, body string, expectedErr string) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				Expect(r.Method).To(Equal("POST"))
+				Expect(r.URL.Path).To(Equal("/evacuate"))
+				w.WriteHeader(status)
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+
+			rep := repInstance{CellID: "cell-0", AdminAddr: strings.TrimPrefix(server.URL, "http://")}
+			err := startEvacuation(rep)
+			Expect(requests).To(Equal(1))
+			if expectedErr == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(expectedErr))
+			}
+		},
+		Entry("accepted", http.StatusAccepted, "", ""),
+		Entry("ok", http.StatusOK, "", ""),
+		Entry("refused", http.StatusServiceUnavailable, "already evacuating\n", "rep of cell-0 refused to evacuate: 503 Service Unavailable already evacuating"),
+		Entry("not found", http.StatusNotFound, "", "rep of cell-0 refused to evacuate: 404 Not Found "),
+	)
+
+	It("fails to evacuate a rep without an admin address", func() {
+		Expect(startEvacuation(repInstance{CellID: "cell-0"})).To(MatchError("no admin address known for the rep of cell-0"))
+	})
+
+	It("fails to evacuate a rep that is not listening", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		addr := strings.TrimPrefix(server.URL, "http://")
+		server.Close()
+
+		err := startEvacuation(repInstance{CellID: "cell-0", AdminAddr: addr})
+		Expect(err).To(MatchError(HavePrefix("requesting evacuation of cell-0: ")))
+	})
+
+	Describe("waitForEvacuation", func() {
+		var (
+			savedBBSClient         bbs.InternalClient
+			savedEvacuationTimeout durationjson.Duration
+			savedGracePeriod       time.Duration
+			savedPollInterval      time.Duration
+			fakeBBS                *fake_bbs.FakeInternalClient
+		)
+
+		BeforeEach(func() {
+			savedBBSClient = bbsClient
+			savedEvacuationTimeout = suite.EvacuationTimeout
+			savedGracePeriod = evacuationGracePeriod
+			savedPollInterval = evacuationPollInterval
+
+			fakeBBS = &fake_bbs.FakeInternalClient{}
+			bbsClient = fakeBBS
+			suite.EvacuationTimeout = durationjson.Duration(100 * time.Millisecond)
+			evacuationGracePeriod = 100 * time.Millisecond
+			evacuationPollInterval = 10 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			bbsClient = savedBBSClient
+			suite.EvacuationTimeout = savedEvacuationTimeout
+			evacuationGracePeriod = savedGracePeriod
+			evacuationPollInterval = savedPollInterval
+		})
+
+		// rep is an evacuating rep that exits after exitAfter, or once
+		// signalled.
+		rep := func(name, cellID string, exitAfter time.Duration) evacuatingCell {
+			process := ifrit.Invoke(ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+				close(ready)
+				select {
+				case <-time.After(exitAfter):
+				case <-signals:
+				}
+				return nil
+			}))
+			return evacuatingCell{repInstance: repInstance{CellID: cellID}, Name: name, Process: process}
+		}
+
+		It("returns once every rep exited", func() {
+			cells := []evacuatingCell{rep("rep/0", "cell-0", 20*time.Millisecond), rep("rep/1", "cell-1", 50*time.Millisecond)}
+			Expect(waitForEvacuation(cells)).To(Succeed())
+		})
+
+		It("gives up after the longest evacuation timeout plus the grace period, listing what was left", func() {
+			fakeBBS.ActualLRPsReturns([]*models.ActualLRP{
+				{
+					ActualLRPKey: models.NewActualLRPKey("guid", 1, "domain"),
+					State:        models.ActualLRPStateClaimed,
+				},
+				{
+					ActualLRPKey: models.NewActualLRPKey("guid", 0, "domain"),
+					State:        models.ActualLRPStateRunning,
+					Presence:     models.ActualLRP_Evacuating,
+				},
+			}, nil)
+
+			stuck := rep("rep/1", "cell-1", time.Hour)
+			defer stuck.Process.Signal(os.Kill)
+			stuck.EvacuationTimeout = 200 * time.Millisecond
+
+			start := time.Now()
+			err := waitForEvacuation([]evacuatingCell{rep("rep/0", "cell-0", 0), stuck})
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+
+			Expect(err).To(MatchError("reps did not finish evacuating within 300ms:\n" +
+				"  rep/1 (cell-1): 2 instances: guid/0 RUNNING EVACUATING, guid/1 CLAIMED"))
+			_, filter := fakeBBS.ActualLRPsArgsForCall(0)
+			Expect(filter.CellID).To(Equal("cell-1"))
+		})
+	})
+})
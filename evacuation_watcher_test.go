@@ -0,0 +1,368 @@
+package dusts_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs/events"
+	"code.cloudfoundry.org/bbs/models"
+	. "github.com/onsi/ginkgo"
+)
+
+// replacementTimeout is how long after its rep exited an evacuated instance
+// may take to have a RUNNING replacement on another cell.
+var replacementTimeout = 30 * time.Second
+
+// unavailableGrace is how long an evacuated instance may have no RUNNING
+// copy before it is a violation. The BBS sends the events of the ordinary
+// and the evacuating instance separately, so the removal of the evacuating
+// one can briefly be seen before its replacement is RUNNING.
+const unavailableGrace = 2 * time.Second
+
+// lrpInstance is the last state of an ActualLRP instance seen by the watcher.
+type lrpInstance struct {
+	ProcessGuid  string
+	Index        int32
+	InstanceGuid string
+	CellID       string
+	State        string
+	Evacuating   bool
+	// PlacementError is why the auctioneer could not place an UNCLAIMED
+	// instance.
+	PlacementError string
+}
+
+func (i lrpInstance) key() string {
+	return fmt.Sprintf("%s/%d", i.ProcessGuid, i.Index)
+}
+
+// id identifies the instance the way the BBS does, by key and presence:
+// unclaimed instances have no instance guid.
+func (i lrpInstance) id() string {
+	return lrpInstanceID(i.ProcessGuid, i.Index, i.Evacuating)
+}
+
+func lrpInstanceID(processGuid string, index int32, evacuating bool) string {
+	if evacuating {
+		return fmt.Sprintf("%s/%d/evacuating", processGuid, index)
+	}
+	return fmt.Sprintf("%s/%d/ordinary", processGuid, index)
+}
+
+func (i lrpInstance) String() string {
+	s := fmt.Sprintf("%s %s on %q", i.InstanceGuid, i.State, i.CellID)
+	if i.Evacuating {
+		s += " EVACUATING"
+	}
+	if i.PlacementError != "" {
+		s += fmt.Sprintf(" (%s)", i.PlacementError)
+	}
+	return s
+}
+
+// lrpTransition is an ActualLRP instance event as recorded by the watcher.
+type lrpTransition struct {
+	Time   time.Time
+	Step   string
+	Key    string
+	Before *lrpInstance
+	After  *lrpInstance
+}
+
+func (t lrpTransition) String() string {
+	describe := func(i *lrpInstance) string {
+		if i == nil {
+			return "-"
+		}
+		return i.String()
+	}
+	return fmt.Sprintf("%s [%s] %s: %s -> %s", t.Time.Format("15:04:05.000"), t.Step, t.Key, describe(t.Before), describe(t.After))
+}
+
+// evacuationWatcher follows the BBS instance event stream while reps
+// evacuate and checks that every instance that was RUNNING on an evacuating
+// cell was evacuated: it was marked EVACUATING on its old cell, a
+// replacement came up RUNNING on another cell, and it never had zero RUNNING
+// copies in between for longer than unavailableGrace.
+//
+// An instance whose replacement the auctioneer failed to place, e.g. since no
+// other cell has room for it, cannot meet either and is only reported.
+type evacuationWatcher struct {
+	source events.EventSource
+	cells  map[string]bool
+
+	mu          sync.Mutex
+	instances   map[string]lrpInstance
+	tracked     map[string]*evacuatedLRP
+	transitions []lrpTransition
+	streamErr   error
+	done        chan struct{}
+}
+
+// evacuatedLRP is an instance that was RUNNING on an evacuating cell.
+type evacuatedLRP struct {
+	cellID     string
+	evacuating bool
+	replaced   bool
+	runningNow bool
+	// placementError is why the replacement could not be placed, if it
+	// was left UNCLAIMED with one.
+	placementError string
+	// downSince is when the instance last lost its only RUNNING copy.
+	downSince   time.Time
+	unavailable []instanceDownWindow
+}
+
+// instanceDownWindow is a time an evacuated instance had no RUNNING copy for
+// longer than unavailableGrace. Until is zero if it never got one again.
+type instanceDownWindow struct {
+	From  time.Time
+	Until time.Time
+}
+
+func (w instanceDownWindow) String() string {
+	if w.Until.IsZero() {
+		return fmt.Sprintf("from %s on", w.From.Format("15:04:05.000"))
+	}
+	return fmt.Sprintf("from %s for %s", w.From.Format("15:04:05.000"), w.Until.Sub(w.From))
+}
+
+// watchEvacuation subscribes to instance events before taking a snapshot of
+// the ActualLRPs, so that no transition between the two is missed.
+func watchEvacuation(cellIDs []string) (*evacuationWatcher, error) {
+	source, err := bbsClient.SubscribeToInstanceEvents(logger)
+	if err != nil {
+		return nil, fmt.Errorf("subscribing to BBS instance events: %s", err)
+	}
+
+	lrps, err := bbsClient.ActualLRPs(logger, models.ActualLRPFilter{})
+	if err != nil {
+		source.Close()
+		return nil, fmt.Errorf("fetching ActualLRPs: %s", err)
+	}
+
+	w := &evacuationWatcher{
+		source:    source,
+		cells:     map[string]bool{},
+		instances: map[string]lrpInstance{},
+		tracked:   map[string]*evacuatedLRP{},
+		done:      make(chan struct{}),
+	}
+	for _, cellID := range cellIDs {
+		w.cells[cellID] = true
+	}
+
+	for _, lrp := range lrps {
+		instance := newLRPInstance(lrp)
+		w.instances[instance.id()] = instance
+		if w.cells[instance.CellID] && instance.State == models.ActualLRPStateRunning && !instance.Evacuating {
+			w.tracked[instance.key()] = &evacuatedLRP{cellID: instance.CellID, runningNow: true}
+		}
+	}
+
+	go w.run()
+	return w, nil
+}
+
+func newLRPInstance(lrp *models.ActualLRP) lrpInstance {
+	return lrpInstance{
+		ProcessGuid:    lrp.ProcessGuid,
+		Index:          lrp.Index,
+		InstanceGuid:   lrp.InstanceGuid,
+		CellID:         lrp.CellId,
+		State:          lrp.State,
+		Evacuating:     lrp.Presence == models.ActualLRP_Evacuating,
+		PlacementError: lrp.PlacementError,
+	}
+}
+
+func (w *evacuationWatcher) run() {
+	defer close(w.done)
+
+	for {
+		event, err := w.source.Next()
+		if err != nil {
+			w.mu.Lock()
+			if err != events.ErrSourceClosed {
+				w.streamErr = err
+			}
+			w.mu.Unlock()
+			return
+		}
+
+		switch e := event.(type) {
+		case *models.ActualLRPInstanceCreatedEvent:
+			after := newLRPInstance(e.ActualLrp)
+			w.apply(nil, &after)
+		case *models.ActualLRPInstanceChangedEvent:
+			before, ok := w.instance(lrpInstanceID(e.ProcessGuid, e.Index, e.Before.Presence == models.ActualLRP_Evacuating))
+			after := lrpInstance{
+				ProcessGuid:    e.ProcessGuid,
+				Index:          e.Index,
+				InstanceGuid:   e.InstanceGuid,
+				CellID:         e.CellId,
+				State:          e.After.State,
+				Evacuating:     e.After.Presence == models.ActualLRP_Evacuating,
+				PlacementError: e.After.PlacementError,
+			}
+			if ok {
+				w.apply(&before, &after)
+			} else {
+				w.apply(nil, &after)
+			}
+		case *models.ActualLRPInstanceRemovedEvent:
+			before := newLRPInstance(e.ActualLrp)
+			w.apply(&before, nil)
+		}
+	}
+}
+
+func (w *evacuationWatcher) instance(id string) (lrpInstance, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	instance, ok := w.instances[id]
+	return instance, ok
+}
+
+func (w *evacuationWatcher) apply(before, after *lrpInstance) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	changed := after
+	if before != nil {
+		delete(w.instances, before.id())
+	}
+	if after != nil {
+		w.instances[after.id()] = *after
+	} else {
+		changed = before
+	}
+
+	transition := lrpTransition{Time: now, Step: upgradeSteps.Current(), Key: changed.key(), Before: before, After: after}
+	w.transitions = append(w.transitions, transition)
+
+	tracked, ok := w.tracked[changed.key()]
+	if !ok {
+		return
+	}
+	fmt.Fprintf(GinkgoWriter, "evacuation: %s\n", transition)
+
+	if after != nil && after.Evacuating && after.CellID == tracked.cellID {
+		tracked.evacuating = true
+	}
+	if after != nil && !after.Evacuating && after.State == models.ActualLRPStateRunning && after.CellID != tracked.cellID {
+		tracked.replaced = true
+	}
+	if after != nil && !after.Evacuating {
+		tracked.placementError = after.PlacementError
+	}
+
+	running := false
+	for _, instance := range w.instances {
+		if instance.key() == changed.key() && instance.State == models.ActualLRPStateRunning {
+			running = true
+		}
+	}
+	switch {
+	case tracked.runningNow && !running:
+		tracked.downSince = now
+	case !tracked.runningNow && running:
+		if now.Sub(tracked.downSince) > unavailableGrace {
+			tracked.unavailable = append(tracked.unavailable, instanceDownWindow{From: tracked.downSince, Until: now})
+		}
+	}
+	tracked.runningNow = running
+}
+
+// Stop waits up to replacementTimeout for every evacuated instance to have a
+// RUNNING replacement, stops watching and returns every violated invariant.
+func (w *evacuationWatcher) Stop() error {
+	deadline := time.Now().Add(replacementTimeout)
+	for time.Now().Before(deadline) && !w.allReplaced() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	w.source.Close()
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	violations := []string{}
+	if w.streamErr != nil {
+		violations = append(violations, fmt.Sprintf("BBS event stream failed: %s", w.streamErr))
+	}
+
+	keys := []string{}
+	for key := range w.tracked {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		tracked := w.tracked[key]
+		if !tracked.evacuating {
+			violations = append(violations, fmt.Sprintf("%s was never EVACUATING on %s", key, tracked.cellID))
+		}
+		if tracked.unplaceable() {
+			fmt.Fprintf(GinkgoWriter, "evacuation: %s could not be placed on another cell: %s\n", key, tracked.placementError)
+			continue
+		}
+		if !tracked.replaced {
+			violations = append(violations, fmt.Sprintf("%s has no RUNNING replacement on another cell", key))
+		}
+		unavailable := tracked.unavailable
+		if !tracked.runningNow && !tracked.downSince.IsZero() && time.Since(tracked.downSince) > unavailableGrace {
+			unavailable = append(unavailable, instanceDownWindow{From: tracked.downSince})
+		}
+		for _, window := range unavailable {
+			violations = append(violations, fmt.Sprintf("%s had no RUNNING instance %s", key, window))
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("evacuation of %s violated:\n  %s\ntransitions:\n  %s", w.cellList(), strings.Join(violations, "\n  "), strings.Join(w.trackedTransitions(), "\n  "))
+}
+
+// unplaceable is whether the replacement was left UNCLAIMED with a placement
+// error and never came up.
+func (e *evacuatedLRP) unplaceable() bool {
+	return !e.replaced && e.placementError != ""
+}
+
+func (w *evacuationWatcher) allReplaced() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, tracked := range w.tracked {
+		if !tracked.replaced && !tracked.unplaceable() {
+			return false
+		}
+	}
+	return true
+}
+
+// trackedTransitions must be called with w.mu held.
+func (w *evacuationWatcher) trackedTransitions() []string {
+	lines := []string{}
+	for _, transition := range w.transitions {
+		if _, ok := w.tracked[transition.Key]; ok {
+			lines = append(lines, transition.String())
+		}
+	}
+	return lines
+}
+
+func (w *evacuationWatcher) cellList() string {
+	cells := []string{}
+	for cell := range w.cells {
+		cells = append(cells, cell)
+	}
+	sort.Strings(cells)
+	return strings.Join(cells, ", ")
+}
@@ -0,0 +1,122 @@
+package dusts_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bbs/models"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	// killDuringMigration makes a kill step of the BBS also kill its
+	// replacement while it migrates the database, before starting it again.
+	killDuringMigration = "migration"
+	// bbsMigrationMarker matches the message the migration-manager session
+	// of the BBS logs before running each migration, and before running all
+	// of them in the releases that log them together.
+	bbsMigrationMarker = `"message":"bbs\.migration-manager\.running-migrations?"`
+	killTimeout        = 5 * time.Second
+	// faultsPlan kills every instance group of the locket release. It is not
+	// a scenario plan, so it only runs when DUSTS_UPGRADE_PLAN points at it.
+	faultsPlan = "plans/diego-locket-local-re-faults.json"
+)
+
+var recoveryTimeout = time.Duration(suite.Poller.MaxRecovery)
+
+// faultBudget applies to every route during kill steps instead of the
+// availability budget: a killed instance may be unavailable until the cluster
+// converges again, but no longer than DUSTS_MAX_RECOVERY.
+var faultBudget = availabilityBudget{
+	MaxUnavailable: recoveryTimeout,
+}
+
+// kill sends SIGKILL to every process before waiting for any of them to
+// exit, like a VM being recreated or the kernel OOM killing a job. Reps are
+// not evacuated.
+func (u *planUpgrader) kill(processes []*planProcess) {
+	for _, p := range processes {
+		p.process.Signal(os.Kill)
+	}
+	for _, p := range processes {
+		EventuallyWithOffset(1, p.process.Wait(), killTimeout).Should(Receive())
+	}
+}
+
+// killOnMigration starts a BBS and kills it as soon as it logs that it is
+// running a migration. It skips the spec if the BBS finishes starting without
+// running one, e.g. when V0 and V1 share the schema version.
+func killOnMigration(name string) func(ifrit.Runner) ifrit.Process {
+	return func(runner ifrit.Runner) ifrit.Process {
+		buffered, ok := runner.(interface {
+			Buffer() *gbytes.Buffer
+		})
+		if !ok {
+			recordFailure(fmt.Sprintf("cannot watch the output of %s for migrations", name), 1)
+		}
+
+		process := ifrit.Background(runner)
+		output := buffered.Buffer()
+		defer output.CancelDetects()
+
+		select {
+		case <-output.Detect(bbsMigrationMarker):
+			By(fmt.Sprintf("killing %s during its migration", name))
+		case <-process.Ready():
+			process.Signal(os.Kill)
+			EventuallyWithOffset(1, process.Wait(), killTimeout).Should(Receive())
+			Skip(fmt.Sprintf("%s started without running a migration, so it cannot be killed during one", name), 1)
+		case err := <-process.Wait():
+			recordFailure(fmt.Sprintf("%s exited before running a migration: %v", name, err), 1)
+		case <-time.After(recoveryTimeout):
+			process.Signal(os.Kill)
+			recordFailure(fmt.Sprintf("%s did not start a migration within DUSTS_MAX_RECOVERY", name), 1)
+		}
+
+		process.Signal(os.Kill)
+		EventuallyWithOffset(1, process.Wait(), killTimeout).Should(Receive())
+		return process
+	}
+}
+
+// waitForConvergence waits up to recoveryTimeout for every rep to have
+// registered its cell and every desired LRP to have all of its instances
+// running.
+func (u *planUpgrader) waitForConvergence() {
+	cells := 0
+	for _, p := range u.processes {
+		if p.Component == componentRep {
+			cells++
+		}
+	}
+
+	By("waiting for the cluster to converge")
+	EventuallyWithOffset(1, func() error {
+		return converged(cells)
+	}, recoveryTimeout, time.Second).Should(Succeed(), "the cluster did not converge within DUSTS_MAX_RECOVERY")
+}
+
+func converged(cells int) error {
+	presences, err := bbsClient.Cells(logger)
+	if err != nil {
+		return err
+	}
+	if len(presences) != cells {
+		return fmt.Errorf("%d of %d cells registered", len(presences), cells)
+	}
+
+	lrps, err := bbsClient.DesiredLRPs(logger, models.DesiredLRPFilter{})
+	if err != nil {
+		return err
+	}
+	for _, lrp := range lrps {
+		if running := runningInstances(lrp.ProcessGuid); running != int(lrp.Instances) {
+			return fmt.Errorf("%s has %d of %d instances running", lrp.ProcessGuid, running, lrp.Instances)
+		}
+	}
+	return nil
+}
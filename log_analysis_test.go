@@ -0,0 +1,188 @@
+package dusts_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lagerError is the log_level of lager errors; fatal lines are above it.
+const lagerError = 2
+
+// logAllowlistPath is the checked-in list of errors components are expected
+// to log during a rolling upgrade.
+var logAllowlistPath = "log_allowlist.json"
+
+type lagerLine struct {
+	Source   string                 `json:"source"`
+	Message  string                 `json:"message"`
+	LogLevel int                    `json:"log_level"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+// componentError groups the error lines logged by one component version
+// with the same lager message.
+type componentError struct {
+	Component string
+	Version   string
+	Message   string
+	Count     int
+	Example   string
+	Files     []string
+}
+
+func (e *componentError) String() string {
+	return fmt.Sprintf("%s %s: %q logged %d times in %s, e.g. %s", e.Component, e.Version, e.Message, e.Count, strings.Join(e.Files, ", "), e.Example)
+}
+
+// analyzeComponentLogs parses the lager output of the processes started by
+// spec until its upgrade finished and groups every error and fatal line.
+// What the components log while they are shut down afterwards is ignored.
+func analyzeComponentLogs(logs *componentLogDir, spec string) ([]*componentError, error) {
+	groups := map[string]*componentError{}
+
+	for _, entry := range logs.Entries(spec) {
+		output, err := logs.UpgradeOutput(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line, ok := parseLagerLine(scanner.Bytes())
+			if !ok || line.LogLevel < lagerError {
+				continue
+			}
+
+			key := strings.Join([]string{entry.Component, entry.Version, line.Message}, "|")
+			group, ok := groups[key]
+			if !ok {
+				group = &componentError{
+					Component: entry.Component,
+					Version:   entry.Version,
+					Message:   line.Message,
+					Example:   fmt.Sprintf("%v", line.Data["error"]),
+				}
+				groups[key] = group
+			}
+			group.Count++
+			if !containsString(group.Files, entry.File) {
+				group.Files = append(group.Files, entry.File)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	errors := []*componentError{}
+	for _, group := range groups {
+		errors = append(errors, group)
+	}
+	sort.Slice(errors, func(i, j int) bool { return errors[i].String() < errors[j].String() })
+	return errors, nil
+}
+
+// parseLagerLine extracts the lager JSON from a line of component output,
+// which is prefixed with the colored name of the process by ginkgomon.
+func parseLagerLine(raw []byte) (lagerLine, bool) {
+	var line lagerLine
+
+	start := bytes.IndexByte(raw, '{')
+	if start < 0 {
+		return line, false
+	}
+
+	err := json.Unmarshal(raw[start:], &line)
+	if err != nil || line.Message == "" {
+		return line, false
+	}
+	return line, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// logAllowlistEntry allows errors whose lager message matches the Message
+// regexp. An empty Component or Version matches any.
+type logAllowlistEntry struct {
+	Component string `json:"component,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Message   string `json:"message"`
+	Reason    string `json:"reason"`
+
+	message *regexp.Regexp
+}
+
+type logAllowlist []logAllowlistEntry
+
+func loadLogAllowlist(path string) (logAllowlist, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist := logAllowlist{}
+	err = json.Unmarshal(contents, &allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("parsing log allowlist %s: %s", path, err)
+	}
+
+	for i := range allowlist {
+		if allowlist[i].Reason == "" {
+			return nil, fmt.Errorf("log allowlist %s: entry %q has no reason", path, allowlist[i].Message)
+		}
+		allowlist[i].message, err = regexp.Compile(allowlist[i].Message)
+		if err != nil {
+			return nil, fmt.Errorf("log allowlist %s: %s", path, err)
+		}
+	}
+
+	return allowlist, nil
+}
+
+func (a logAllowlist) allows(e *componentError) bool {
+	for _, entry := range a {
+		if entry.Component != "" && entry.Component != e.Component {
+			continue
+		}
+		if entry.Version != "" && entry.Version != e.Version {
+			continue
+		}
+		if entry.message.MatchString(e.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unexpected returns the errors not covered by the allowlist.
+func (a logAllowlist) Unexpected(errors []*componentError) []*componentError {
+	unexpected := []*componentError{}
+	for _, e := range errors {
+		if !a.allows(e) {
+			unexpected = append(unexpected, e)
+		}
+	}
+	return unexpected
+}
+
+func formatComponentErrors(errors []*componentError) string {
+	lines := []string{}
+	for _, e := range errors {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,182 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	archive_helper "code.cloudfoundry.org/archiver/extractor/test_helper"
+	"code.cloudfoundry.org/guardian/gqt/runner"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ = Describe("docker registry", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "dusts-registry-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	Describe("ociRegistry", func() {
+		var (
+			server   *httptest.Server
+			manifest ociDescriptor
+			layer    ociDescriptor
+		)
+
+		BeforeEach(func() {
+			Expect(writeGoServerImage(tmpDir, []archive_helper.ArchiveFile{{Name: "go-server", Body: "#!/bin/sh\n"}})).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+			var index ociIndex
+			Expect(json.Unmarshal(contents, &index)).To(Succeed())
+			Expect(index.Manifests).To(HaveLen(1))
+			manifest = index.Manifests[0]
+
+			contents, err = ioutil.ReadFile(filepath.Join(tmpDir, "blobs", "sha256", manifest.Digest[len("sha256:"):]))
+			Expect(err).NotTo(HaveOccurred())
+			var m ociManifest
+			Expect(json.Unmarshal(contents, &m)).To(Succeed())
+			layer = m.Layers[0]
+
+			server = httptest.NewServer(&ociRegistry{layoutDir: tmpDir, image: dockerCanaryImage})
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		request := func(method, path string) (*http.Response, []byte) {
+			req, err := http.NewRequest(method, server.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Header.Get("Docker-Distribution-API-Version")).To(Equal("registry/2.0"))
+			return resp, body
+		}
+
+		DescribeTable("routing",
+			func(method, path string, status int) {
+				resp, _ := request(method, path)
+				Expect(resp.StatusCode).To(Equal(status))
+			},
+			Entry("the v2 API check", "GET", "/v2/", http.StatusOK),
+			Entry("the v2 API check without a slash", "GET", "/v2", http.StatusOK),
+			Entry("a write", "PUT", "/v2/"+dockerCanaryImage+"/manifests/latest", http.StatusMethodNotAllowed),
+			Entry("another image", "GET", "/v2/dusts/other/manifests/latest", http.StatusNotFound),
+			Entry("an unknown tag", "GET", "/v2/"+dockerCanaryImage+"/manifests/v1", http.StatusNotFound),
+			Entry("an unknown endpoint of the image", "GET", "/v2/"+dockerCanaryImage+"/tags/list", http.StatusNotFound),
+			Entry("the image without an endpoint", "GET", "/v2/"+dockerCanaryImage+"/manifests", http.StatusNotFound),
+		)
+
+		It("serves the manifest by tag and by digest", func() {
+			for _, reference := range []string{dockerCanaryTag, manifest.Digest} {
+				resp, body := request("GET", "/v2/"+dockerCanaryImage+"/manifests/"+reference)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Content-Type")).To(Equal(ociManifestMediaType))
+				Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(manifest.Digest))
+				Expect(sha256Digest(body)).To(Equal(manifest.Digest))
+			}
+		})
+
+		It("serves blobs by digest, without a body for HEAD", func() {
+			resp, body := request("GET", "/v2/"+dockerCanaryImage+"/blobs/"+layer.Digest)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(sha256Digest(body)).To(Equal(layer.Digest))
+			Expect(int64(len(body))).To(Equal(layer.Size))
+
+			resp, body = request("HEAD", "/v2/"+dockerCanaryImage+"/blobs/"+layer.Digest)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.ContentLength).To(Equal(layer.Size))
+			Expect(body).To(BeEmpty())
+		})
+
+		DescribeTable("rejects digests",
+			func(digest string) {
+				resp, _ := request("GET", "/v2/"+dockerCanaryImage+"/blobs/"+digest)
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			},
+			Entry("of another algorithm", "sha512:abc"),
+			Entry("without an algorithm", "abc"),
+			Entry("of a blob not in the layout", "sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+			Entry("escaping the blobs directory", "sha256:..%2F..%2Findex.json"),
+			Entry("with a dot", "sha256:abc.json"),
+		)
+	})
+
+	Describe("writeTrustingGrootFSConfig", func() {
+		writeConfig := func(contents string) string {
+			path := filepath.Join(tmpDir, "grootfs.yml")
+			Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+			return path
+		}
+
+		readConfig := func(path string) map[string]interface{} {
+			contents, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			var document interface{}
+			Expect(yaml.Unmarshal(contents, &document)).To(Succeed())
+			return jsonCompatible(document).(map[string]interface{})
+		}
+
+		It("adds the registry to the insecure registries of a copy of the config", func() {
+			path := writeConfig("store: /var/vcap/data/grootfs\ncreate:\n  insecure_registries: [\"registry.example.com\"]\n  with_clean: true\n")
+
+			trustedPath, err := writeTrustingGrootFSConfig(path, "127.0.0.1:5000")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(trustedPath).To(Equal(filepath.Join(tmpDir, "grootfs-dusts.yml")))
+
+			config := readConfig(trustedPath)
+			Expect(config["store"]).To(Equal("/var/vcap/data/grootfs"))
+			create := config["create"].(map[string]interface{})
+			Expect(create["with_clean"]).To(Equal(true))
+			Expect(create["insecure_registries"]).To(Equal([]interface{}{"registry.example.com", "127.0.0.1:5000"}))
+
+			Expect(readConfig(path)["create"].(map[string]interface{})["insecure_registries"]).To(HaveLen(1))
+		})
+
+		It("adds a create section to a config without one", func() {
+			trustedPath, err := writeTrustingGrootFSConfig(writeConfig("store: /store\n"), "127.0.0.1:5000")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readConfig(trustedPath)["create"]).To(Equal(map[string]interface{}{
+				"insecure_registries": []interface{}{"127.0.0.1:5000"},
+			}))
+		})
+
+		It("fails on a config that is not YAML", func() {
+			path := writeConfig("store: [\n")
+			_, err := writeTrustingGrootFSConfig(path, "127.0.0.1:5000")
+			Expect(err).To(MatchError(HavePrefix("parsing grootfs config " + path)))
+		})
+
+		It("points the --config of both image plugins at the copy", func() {
+			path := writeConfig("store: /store\n")
+			cfg := &runner.GdnRunnerConfig{
+				ImagePluginExtraArgs:           []string{`"--store"`, `"/store"`, `"--config"`, `"` + path + `"`},
+				PrivilegedImagePluginExtraArgs: []string{"--config", path},
+			}
+
+			Expect(trustRegistryInGrootFS(cfg, "127.0.0.1:5000")).To(Succeed())
+
+			trustedPath := filepath.Join(tmpDir, "grootfs-dusts.yml")
+			Expect(cfg.ImagePluginExtraArgs).To(Equal([]string{`"--store"`, `"/store"`, `"--config"`, trustedPath}))
+			Expect(cfg.PrivilegedImagePluginExtraArgs).To(Equal([]string{"--config", trustedPath}))
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package dusts_test
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+)
+
+var _ = Describe("planUpgrader", func() {
+	var (
+		u       *planUpgrader
+		started []string
+		failing string
+	)
+
+	BeforeEach(func() {
+		IntermediateComponentMakers = nil
+		started = nil
+		failing = ""
+
+		plan := &UpgradePlan{
+			Name: "brain",
+			StartUp: []PlanProcess{
+				{Component: componentBBS},
+				{Component: componentAuctioneer},
+			},
+			Steps: []PlanStep{
+				{Action: actionUpgrade, Component: componentBBS, InstanceGroup: "brain"},
+				{Action: actionUpgrade, Component: componentAuctioneer, InstanceGroup: "brain"},
+			},
+		}
+		u = NewPlanUpgrader(plan).(*planUpgrader)
+
+		u.makeRunner = func(p *planProcess, generation int, mutators []string) ifrit.Runner {
+			name := fmt.Sprintf("%s v%d", instanceName(p.Component, p.Index), generation)
+			started = append(started, name)
+			return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+				close(ready)
+				<-signals
+				return nil
+			})
+		}
+		u.start = func(runner ifrit.Runner) ifrit.Process {
+			if started[len(started)-1] == failing {
+				panic(failing + " failed to start")
+			}
+			return ginkgomon.Invoke(runner)
+		}
+
+		u.StartUp()
+	})
+
+	AfterEach(func() {
+		u.ShutDown()
+	})
+
+	It("rolls back a batch that failed partway through", func() {
+		failing = "auctioneer/0 v1"
+		Expect(u.RollingUpgrade).To(Panic())
+
+		u.Rollback()
+
+		Expect(started).To(Equal([]string{
+			"bbs/0 v0",
+			"auctioneer/0 v0",
+			"bbs/0 v1",
+			"auctioneer/0 v1",
+			"auctioneer/0 v0",
+			"bbs/0 v0",
+		}))
+		for name, p := range u.processes {
+			Expect(p.generation).To(Equal(0), "%s was not rolled back", name)
+			Expect(p.process.Wait()).NotTo(Receive(), "%s is not running", name)
+		}
+		Expect(u.applied).To(BeEmpty())
+	})
+})
@@ -0,0 +1,199 @@
+package dusts_test
+
+import (
+	"math/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UpgradePlan", func() {
+	loadPlan := func(path string) *UpgradePlan {
+		plan, err := LoadUpgradePlan(path)
+		Expect(err).NotTo(HaveOccurred())
+		return plan
+	}
+
+	registeredPlan := func(name string) *UpgradePlan {
+		for _, capabilities := range releaseRegistry {
+			if capabilities.Name == name {
+				return loadPlan(capabilities.UpgradePlan)
+			}
+		}
+		Fail("no release capabilities named " + name)
+		return nil
+	}
+
+	It("has valid scenario plans that start the processes of the plan of their release", func() {
+		for _, capabilities := range releaseRegistry {
+			plan := loadPlan(capabilities.UpgradePlan)
+			for _, path := range capabilities.ScenarioPlans {
+				scenario := loadPlan(path)
+				Expect(scenario.Validate(plan.CellCount())).To(Succeed(), path)
+				Expect(scenario.Processes(plan.CellCount())).To(Equal(plan.Processes(plan.CellCount())), path)
+			}
+		}
+	})
+
+	Describe("release components", func() {
+		registeredRelease := func(name string) *diegoRelease {
+			for _, capabilities := range releaseRegistry {
+				if capabilities.Name == name {
+					return &diegoRelease{Version: capabilities.MinVersion, releaseCapabilities: capabilities}
+				}
+			}
+			Fail("no release capabilities named " + name)
+			return nil
+		}
+
+		It("only starts and upgrades components of each registered release", func() {
+			for _, capabilities := range releaseRegistry {
+				release := registeredRelease(capabilities.Name)
+				Expect(release.Validate(append([]string{release.UpgradePlan}, release.ScenarioPlans...)...)).To(Succeed(), release.Name)
+			}
+		})
+
+		It("accepts the opt-in fault injection plan of the locket release", func() {
+			release := registeredRelease("diego-locket-local-re")
+			Expect(release.ScenarioPlans).NotTo(ContainElement(faultsPlan))
+			Expect(release.Validate(faultsPlan)).To(Succeed())
+
+			plan, faults := registeredPlan("diego-locket-local-re"), loadPlan(faultsPlan)
+			Expect(faults.Processes(plan.CellCount())).To(Equal(plan.Processes(plan.CellCount())))
+		})
+
+		It("rejects a plan starting a component the release does not have", func() {
+			release := registeredRelease("diego-ga")
+			Expect(release.ValidatePlan(registeredPlan("diego-locket-local-re"))).To(MatchError("diego-locket-local-re: diego-release v1.0.0 has no locket"))
+		})
+
+		It("rejects a vizzini stage upgrading a component the release does not have", func() {
+			release := registeredRelease("diego-ga")
+			release.VizziniStages = []vizziniStage{{Name: "locket", Upgraded: []string{componentLocket}}}
+			Expect(release.ValidateVizziniStages()).To(MatchError(`vizzini stage "locket": diego-release v1.0.0 has no locket`))
+		})
+
+		It("rejects a vizzini stage with a mutator of another component", func() {
+			release := registeredRelease("diego-ga")
+			release.VizziniStages = []vizziniStage{{
+				Name:     "bbs",
+				Mutators: map[string][]string{componentBBS: {"disable-auctioneer-ssl"}},
+			}}
+			Expect(release.ValidateVizziniStages()).To(MatchError(`vizzini stage "bbs": mutator "disable-auctioneer-ssl" does not apply to bbs`))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("reports the index of the step in the plan", func() {
+			plan := &UpgradePlan{
+				Name:    "cells",
+				Cells:   2,
+				StartUp: []PlanProcess{{Component: componentBBS}, {Component: componentRep, PerCell: true}},
+				Steps: []PlanStep{
+					{Action: actionUpgrade, Component: componentRep, PerCell: true},
+					{Action: actionUpgrade, Component: componentLocket},
+				},
+			}
+			Expect(plan.Validate(2)).To(MatchError("step 1: locket/0 is never started"))
+		})
+
+		DescribeTable("validates kill_during",
+			func(step PlanStep, expectedErr string) {
+				plan := &UpgradePlan{
+					Name:    "faults",
+					StartUp: []PlanProcess{{Component: componentBBS}, {Component: componentAuctioneer}},
+					Steps:   []PlanStep{step},
+				}
+				if expectedErr == "" {
+					Expect(plan.Validate(1)).To(Succeed())
+				} else {
+					Expect(plan.Validate(1)).To(MatchError(expectedErr))
+				}
+			},
+			Entry("a migration kill of the BBS",
+				PlanStep{Action: actionKill, Component: componentBBS, KillDuring: killDuringMigration}, ""),
+			Entry("an unknown phase",
+				PlanStep{Action: actionKill, Component: componentBBS, KillDuring: "startup"}, `step 0: unknown kill_during "startup"`),
+			Entry("an upgrade of the BBS",
+				PlanStep{Action: actionUpgrade, Component: componentBBS, KillDuring: killDuringMigration}, "step 0: only kill steps of the BBS can kill during a migration"),
+			Entry("a kill of another component",
+				PlanStep{Action: actionKill, Component: componentAuctioneer, KillDuring: killDuringMigration}, "step 0: only kill steps of the BBS can kill during a migration"),
+		)
+	})
+
+	Describe("validateUpgradeChain", func() {
+		It("accepts the GA to locket-local-re chain of the release registry", func() {
+			hops := []*UpgradePlan{registeredPlan("diego-ga"), registeredPlan("diego-locket-local-re")}
+			Expect(validateUpgradeChain(hops, hops[0].CellCount())).To(Succeed())
+		})
+
+		It("validates every hop", func() {
+			later := &UpgradePlan{
+				Name:    "later",
+				StartUp: []PlanProcess{{Component: componentBBS}},
+				Steps:   []PlanStep{{Action: actionUpgrade, Component: componentLocket}},
+			}
+			hops := []*UpgradePlan{registeredPlan("diego-ga"), later}
+			Expect(validateUpgradeChain(hops, 2)).To(MatchError("later: step 0: locket/0 is never started"))
+		})
+	})
+
+	Describe("upgrade orders", func() {
+		DescribeTable("counts every order of the registered plans",
+			func(name string, cells, batchSize, count int) {
+				plan := registeredPlan(name)
+				orders, err := allTopologicalOrders(plan.batchGraph(cells, batchSize), maxUpgradeOrders)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(orders).To(HaveLen(count))
+			},
+			// The BBS goes first, then the other five batches in any order.
+			Entry("diego-ga", "diego-ga", 2, 1, 120),
+			Entry("diego-ga with both cells at once", "diego-ga", 2, 2, 24),
+			// diego-api goes before the five batches depending on the BBS, and
+			// the file server anywhere.
+			Entry("diego-locket-local-re", "diego-locket-local-re", 2, 1, 840),
+			Entry("diego-locket-local-re with both cells at once", "diego-locket-local-re", 2, 2, 30),
+		)
+
+		It("fails past maxUpgradeOrders", func() {
+			_, err := allTopologicalOrders(make([][]int, 7), maxUpgradeOrders)
+			Expect(err).To(MatchError("more than 1000 orders"))
+		})
+
+		It("samples the same orders for the same seed", func() {
+			graph := registeredPlan("diego-locket-local-re").batchGraph(2, 1)
+			sample := func(seed int64) [][]int {
+				return sampleTopologicalOrders(graph, 10, rand.New(rand.NewSource(seed)))
+			}
+
+			orders := sample(42)
+			Expect(orders).To(HaveLen(10))
+			Expect(sample(42)).To(Equal(orders))
+
+			all, err := allTopologicalOrders(graph, maxUpgradeOrders)
+			Expect(err).NotTo(HaveOccurred())
+			for _, order := range orders {
+				Expect(all).To(ContainElement(order))
+			}
+		})
+
+		It("keeps the cells of a batch together when reordering", func() {
+			plan := registeredPlan("diego-locket-local-re")
+			batches := plan.Batches(2, 2)
+			order := []int{1, 0, 3, 2, 4}
+
+			reordered := plan.Reordered(2, 2, order).Batches(2, 2)
+			Expect(reordered).To(HaveLen(len(batches)))
+			for i, b := range order {
+				Expect(reordered[i].Description).To(Equal(batches[b].Description))
+				Expect(reordered[i].Steps).To(HaveLen(len(batches[b].Steps)))
+				for j, step := range reordered[i].Steps {
+					Expect(instanceName(step.Component, step.Index)).To(Equal(instanceName(batches[b].Steps[j].Component, batches[b].Steps[j].Index)))
+					Expect(step.Action).To(Equal(batches[b].Steps[j].Action))
+				}
+			}
+			Expect(reordered[2].Steps).To(HaveLen(2), "the reps of both cells are one batch")
+		})
+	})
+})
@@ -0,0 +1,40 @@
+package dusts_test
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("poller stats", func() {
+	It("attributes an outage spanning two steps to the step it started in", func() {
+		start := time.Now()
+		sample := func(offset time.Duration, step string, ok bool) pollSample {
+			s := pollSample{Time: start.Add(offset), Step: step, Status: http.StatusOK}
+			if !ok {
+				s.Status = 0
+				s.Err = errors.New("connection refused")
+			}
+			return s
+		}
+
+		c := &poller{route: "dust-canary", samples: []pollSample{
+			sample(0, "step 1", true),
+			sample(1*time.Second, "step 1", false),
+			sample(2*time.Second, "step 1", false),
+			sample(3*time.Second, "step 2", false),
+			sample(4*time.Second, "step 2", true),
+		}}
+
+		stats := c.StatsByStep()
+		Expect(stats).To(HaveLen(2))
+		Expect(stats[0].LongestUnavailable).To(Equal(3 * time.Second))
+		Expect(stats[1].LongestUnavailable).To(BeZero())
+
+		Expect(c.StatsBetween(start, start.Add(3*time.Second)).LongestUnavailable).To(Equal(3 * time.Second))
+		Expect(availabilityBudget{MaxUnavailable: 2 * time.Second}.Verify(stats)).To(HaveOccurred())
+	})
+})
@@ -1,10 +1,12 @@
 package dusts_test
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/inigo/helpers"
@@ -13,22 +15,52 @@ import (
 	. "github.com/onsi/ginkgo"
 )
 
-var nRetries = 10
+var (
+	failureBackoff = time.Duration(suite.Poller.FailureBackoff)
+	pollerRetries  = suite.Poller.Retries
+)
+
+// pollSample is the outcome of a single request through the router.
+type pollSample struct {
+	Time    time.Time
+	Step    string
+	Status  int
+	Latency time.Duration
+	Err     error
+}
+
+func (s pollSample) failed() bool {
+	return s.Status != http.StatusOK
+}
+
+// probe makes a single request to a route and returns its status, using
+// http.StatusOK for success on protocols other than HTTP.
+type probe func() (int, error)
 
 type poller struct {
-	logger     lager.Logger
-	routerAddr string
-	host       string
+	logger lager.Logger
+	route  string
+	probe  probe
+
+	mu      sync.Mutex
+	samples []pollSample
 }
 
+// NewPoller polls an HTTP route through gorouter.
 func NewPoller(logger lager.Logger, routerAddr, host string) *poller {
 	return &poller{
-		logger:     logger,
-		routerAddr: routerAddr,
-		host:       host,
+		logger: logger,
+		route:  host,
+		probe: func() (int, error) {
+			_, status, err := helpers.ResponseBodyAndStatusCodeFromHost(routerAddr, host)
+			return status, err
+		},
 	}
 }
 
+// Run waits for the route to become available, then records every request
+// until signalled. It never fails on its own: use Stats to check the
+// recorded samples against an availabilityBudget.
 func (c *poller) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
 	defer GinkgoRecover()
 
@@ -40,7 +72,7 @@ loop:
 			return nil
 
 		default:
-			_, status, _ := helpers.ResponseBodyAndStatusCodeFromHost(c.routerAddr, c.host)
+			status, _ := c.probe()
 
 			if status == http.StatusOK {
 				break loop
@@ -57,36 +89,227 @@ loop:
 			return nil
 
 		default:
-			status, err := c.pollWithRetries()
-			if err != nil {
-				return err
+			sample := c.poll()
+			if sample.failed() {
+				c.logger.Info("poller-request-failed", lager.Data{"status": sample.Status, "error": sample.Err, "step": sample.Step})
+				time.Sleep(failureBackoff)
 			}
+		}
+	}
+}
 
-			if status != http.StatusOK {
-				return errors.New(fmt.Sprintf("request failed with status %d", status))
-			}
+// poll records a single request, retried up to pollerRetries times while the
+// route is not found. The latency of the sample includes the retries.
+func (c *poller) poll() pollSample {
+	start := time.Now()
+	status, err := c.probe()
+	for retry := 0; retry < pollerRetries && status == http.StatusNotFound; retry++ {
+		c.logger.Info("poller-status-not-found", lager.Data{"status": status, "error": err, "retry": retry})
+		time.Sleep(failureBackoff)
+		status, err = c.probe()
+	}
+
+	sample := pollSample{
+		Time:    start,
+		Step:    upgradeSteps.Current(),
+		Status:  status,
+		Latency: time.Since(start),
+		Err:     err,
+	}
+
+	c.mu.Lock()
+	c.samples = append(c.samples, sample)
+	c.mu.Unlock()
+
+	return sample
+}
+
+func (c *poller) Samples() []pollSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]pollSample{}, c.samples...)
+}
+
+// Stats summarizes all samples recorded so far.
+func (c *poller) Stats() PollerStats {
+	return computePollerStats(c.Samples())
+}
+
+// StatsByStep summarizes the samples recorded during each upgrade step, in
+// the order the steps ran. A step that runs twice is reported twice. Every
+// unavailable window counts in full towards the step it started in, even if
+// it lasted into the next steps.
+func (c *poller) StatsByStep() []PollerStats {
+	stats := []PollerStats{}
+
+	samples := c.Samples()
+	windows := unavailableWindows(samples)
+	for start := 0; start < len(samples); {
+		end := start
+		for end < len(samples) && samples[end].Step == samples[start].Step {
+			end++
 		}
+
+		s := computePollerStats(samples[start:end])
+		s.Route = c.route
+		s.Step = samples[start].Step
+		s.LongestUnavailable = longestUnavailable(windows, func(w unavailableWindow) bool {
+			return w.first >= start && w.first < end
+		})
+		stats = append(stats, s)
+		start = end
 	}
+
+	return stats
 }
 
-func (c *poller) pollWithRetries() (int, error) {
-	var status, retry int
-	var err error
+// StatsBetween summarizes the samples taken in [start, end). A zero end
+// includes every sample after start. Like in StatsByStep, unavailable windows
+// that started in the interval count in full.
+func (c *poller) StatsBetween(start, end time.Time) PollerStats {
+	all := c.Samples()
+	samples := []pollSample{}
+	for _, sample := range all {
+		if sample.Time.Before(start) || (!end.IsZero() && !sample.Time.Before(end)) {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	stats := computePollerStats(samples)
+	stats.Route = c.route
+	stats.LongestUnavailable = longestUnavailable(unavailableWindows(all), func(w unavailableWindow) bool {
+		return !w.Start.Before(start) && (end.IsZero() || w.Start.Before(end))
+	})
+	return stats
+}
 
-	for retry = 0; retry <= nRetries; retry++ {
-		_, status, err = helpers.ResponseBodyAndStatusCodeFromHost(c.routerAddr, c.host)
+// unavailableWindow lasts from a failed request until the next successful
+// one, or until the end of the last request if none succeeded.
+type unavailableWindow struct {
+	Start time.Time
+	End   time.Time
+	// first is the index of the first failed sample of the window.
+	first int
+}
 
-		switch status {
-		case http.StatusNotFound:
-			c.logger.Info("poller-status-not-found", lager.Data{"status": status, "error": err, "retry": retry})
-			time.Sleep(100 * time.Millisecond)
+// unavailableWindows expects samples in the order they were taken.
+func unavailableWindows(samples []pollSample) []unavailableWindow {
+	windows := []unavailableWindow{}
+	open := -1
+	for i, sample := range samples {
+		if sample.failed() {
+			if open < 0 {
+				open = i
+			}
 			continue
-		default:
-			c.logger.Info("poller-exit-status", lager.Data{"status": status, "error": err, "retry": retry})
-			return status, err
 		}
+		if open >= 0 {
+			windows = append(windows, unavailableWindow{Start: samples[open].Time, End: sample.Time, first: open})
+			open = -1
+		}
+	}
+	if open >= 0 {
+		last := samples[len(samples)-1]
+		windows = append(windows, unavailableWindow{Start: samples[open].Time, End: last.Time.Add(last.Latency), first: open})
 	}
+	return windows
+}
+
+func longestUnavailable(windows []unavailableWindow, include func(unavailableWindow) bool) time.Duration {
+	var longest time.Duration
+	for _, w := range windows {
+		if d := w.End.Sub(w.Start); include(w) && d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+type PollerStats struct {
+	Route              string        `json:"route,omitempty"`
+	Step               string        `json:"step,omitempty"`
+	Requests           int           `json:"requests"`
+	FailedRequests     int           `json:"failed_requests"`
+	LongestUnavailable time.Duration `json:"longest_unavailable_ns"`
+	LatencyP50         time.Duration `json:"latency_p50_ns"`
+	LatencyP90         time.Duration `json:"latency_p90_ns"`
+	LatencyP99         time.Duration `json:"latency_p99_ns"`
+	LatencyMax         time.Duration `json:"latency_max_ns"`
+	FirstFailure       time.Time     `json:"first_failure"`
+}
 
-	c.logger.Info("poller-no-more-retries", lager.Data{"status": status, "error": err, "retry": retry})
-	return status, err
+func (s PollerStats) String() string {
+	return fmt.Sprintf(
+		"%s: %s: %d requests, %d failed, longest unavailable %s, p50 %s, p90 %s, p99 %s, max %s",
+		s.Step, s.Route, s.Requests, s.FailedRequests, s.LongestUnavailable, s.LatencyP50, s.LatencyP90, s.LatencyP99, s.LatencyMax,
+	)
+}
+
+// computePollerStats expects samples in the order they were taken. An
+// unavailable window lasts from the first failed request until the next
+// successful one.
+func computePollerStats(samples []pollSample) PollerStats {
+	stats := PollerStats{Requests: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	latencies := make([]time.Duration, 0, len(samples))
+	for _, sample := range samples {
+		latencies = append(latencies, sample.Latency)
+
+		if sample.failed() {
+			stats.FailedRequests++
+			if stats.FirstFailure.IsZero() {
+				stats.FirstFailure = sample.Time
+			}
+		}
+	}
+	stats.LongestUnavailable = longestUnavailable(unavailableWindows(samples), func(unavailableWindow) bool { return true })
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.LatencyP50 = percentile(latencies, 50)
+	stats.LatencyP90 = percentile(latencies, 90)
+	stats.LatencyP99 = percentile(latencies, 99)
+	stats.LatencyMax = latencies[len(latencies)-1]
+
+	return stats
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// availabilityBudget is how much unavailability and latency a route may see
+// during any single upgrade step. Zero values are not checked.
+type availabilityBudget struct {
+	MaxUnavailable time.Duration
+	MaxLatencyP99  time.Duration
+}
+
+var canaryBudget = availabilityBudget{
+	MaxUnavailable: time.Duration(suite.Poller.MaxUnavailable),
+	MaxLatencyP99:  time.Duration(suite.Poller.MaxLatencyP99),
+}
+
+// Verify returns an error listing every step whose stats exceed the budget.
+func (b availabilityBudget) Verify(stats []PollerStats) error {
+	violations := []string{}
+	for _, s := range stats {
+		if b.MaxUnavailable > 0 && s.LongestUnavailable > b.MaxUnavailable {
+			violations = append(violations, fmt.Sprintf("%s: %s unavailable for %s (budget %s)", s.Step, s.Route, s.LongestUnavailable, b.MaxUnavailable))
+		}
+		if b.MaxLatencyP99 > 0 && s.LatencyP99 > b.MaxLatencyP99 {
+			violations = append(violations, fmt.Sprintf("%s: %s p99 latency %s (budget %s)", s.Step, s.Route, s.LatencyP99, b.MaxLatencyP99))
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("availability budget exceeded:\n%s", strings.Join(violations, "\n"))
+	}
+	return nil
 }
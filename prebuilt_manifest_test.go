@@ -0,0 +1,105 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("prebuilt executables", func() {
+	var (
+		dir string
+		// testBinary is this suite's own test binary, whose build info the
+		// version checks run against.
+		testBinary string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dusts-prebuilt-")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "rep"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "not-executable"), []byte("data"), 0644)).To(Succeed())
+
+		testBinary, err = os.Executable()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	DescribeTable("manifest validation",
+		func(executable func() prebuiltExecutable, releaseChecked bool, expectedProblem string) {
+			manifest := prebuiltManifest{Executables: map[string]prebuiltExecutable{"rep": executable()}}
+			executables, err := manifest.load(dir, []string{"rep"}, releaseChecked)
+			if expectedProblem == "" {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(executables).To(HaveKey("rep"))
+			} else {
+				Expect(err).To(MatchError(ContainSubstring("rep: " + expectedProblem)))
+				Expect(executables).To(BeNil())
+			}
+		},
+		Entry("a relative path checked by the release",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: "rep"} }, true, ""),
+		Entry("no version or revision without a release",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: "rep"} }, false, "the manifest has no version or revision to check"),
+		Entry("a missing binary",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: "missing"} }, true, "no such file or directory"),
+		Entry("a binary that is not executable",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: "not-executable"} }, true, "is not executable"),
+		Entry("a directory",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: "."} }, true, "is not executable"),
+		Entry("a version of a binary without build info",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: "rep", Version: "v1.0.0"} }, false, "reading build info"),
+		Entry("another version of the main module",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: testBinary, Version: "v0.0.1-other"} }, false, "the manifest expects v0.0.1-other"),
+		Entry("a module the binary does not have",
+			func() prebuiltExecutable {
+				return prebuiltExecutable{Path: testBinary, Module: "example.com/missing", Version: "v1.0.0"}
+			}, false, "example.com/missing is not a module of"),
+		Entry("another revision",
+			func() prebuiltExecutable { return prebuiltExecutable{Path: testBinary, Revision: "0123abc"} }, false, "the manifest expects 0123abc"),
+	)
+
+	It("reports every missing and mismatching executable at once", func() {
+		manifest := prebuiltManifest{Executables: map[string]prebuiltExecutable{
+			"rep": {Path: "not-executable"},
+		}}
+		_, err := manifest.load(dir, []string{"bbs", "rep"}, true)
+		Expect(err).To(MatchError(ContainSubstring("bbs: not in the manifest\n  rep: ")))
+	})
+
+	Describe("loadPrebuiltExecutables", func() {
+		writeManifest := func(manifest prebuiltManifest) {
+			contents, err := json.Marshal(manifest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(dir, prebuiltManifestName), contents, 0644)).To(Succeed())
+		}
+
+		It("loads the manifest of a directory", func() {
+			writeManifest(prebuiltManifest{Release: "v2.0.0", Executables: map[string]prebuiltExecutable{"rep": {Path: "rep"}}})
+			executables, err := loadPrebuiltExecutables(dir, []string{"rep"}, "v2.0.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(executables).To(HaveKeyWithValue("rep", filepath.Join(dir, "rep")))
+		})
+
+		It("rejects a directory without a manifest", func() {
+			_, err := loadPrebuiltExecutables(dir, []string{"rep"}, "v2.0.0")
+			Expect(err).To(MatchError(ContainSubstring("has no " + prebuiltManifestName)))
+		})
+
+		It("rejects the manifest of another release", func() {
+			writeManifest(prebuiltManifest{Release: "v1.0.0", Executables: map[string]prebuiltExecutable{"rep": {Path: "rep"}}})
+			_, err := loadPrebuiltExecutables(filepath.Join(dir, prebuiltManifestName), []string{"rep"}, "v2.0.0")
+			Expect(err).To(MatchError(ContainSubstring(`is for release "v1.0.0", expected v2.0.0`)))
+		})
+	})
+})
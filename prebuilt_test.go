@@ -0,0 +1,205 @@
+package dusts_test
+
+import (
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/inigo/world"
+)
+
+// prebuiltManifestName is the manifest looked up in a directory of prebuilt
+// executables. It is distinct from the manifest.json of the binary cache.
+const prebuiltManifestName = "prebuilt.json"
+
+// prebuiltManifest lists prebuilt executables, e.g. extracted from a release
+// tarball, by their key in world.BuiltExecutables.
+type prebuiltManifest struct {
+	Release     string                        `json:"release,omitempty"`
+	Executables map[string]prebuiltExecutable `json:"executables"`
+}
+
+// prebuiltExecutable is a binary in a prebuilt manifest. Path is relative to
+// the manifest. Version and Revision, when set, are checked against the build
+// info of the binary: Version is the version of Module (the main module when
+// empty) and Revision the vcs.revision it was built from. Binaries built in a
+// GOPATH have neither in their build info and are checked by the Release of
+// the manifest instead.
+type prebuiltExecutable struct {
+	Path     string `json:"path"`
+	Module   string `json:"module,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// prebuiltPath returns the directory or manifest of prebuilt executables
+// given by DUSTS_PREBUILT_BINARIES plus envSuffix, e.g.
+// DUSTS_PREBUILT_BINARIES_V0, or "" to build from source.
+func prebuiltPath(envSuffix string) string {
+	return suite.Prebuilt("DUSTS_PREBUILT_BINARIES" + envSuffix)
+}
+
+// loadPrebuiltExecutables loads the executables in names from path, which is
+// either a manifest or a directory with a prebuilt.json. release is the
+// diego-release version the executables must belong to, or "" when they are
+// not of a release.
+func loadPrebuiltExecutables(path string, names []string, release string) (world.BuiltExecutables, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestPath := path
+	if info.IsDir() {
+		manifestPath = filepath.Join(path, prebuiltManifestName)
+		if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s has no %s to check the versions of its executables against", path, prebuiltManifestName)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := prebuiltManifest{}
+	err = json.Unmarshal(contents, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", manifestPath, err)
+	}
+	if release != "" && manifest.Release != release {
+		return nil, fmt.Errorf("%s is for release %q, expected %s", manifestPath, manifest.Release, release)
+	}
+	return manifest.load(filepath.Dir(manifestPath), names, release != "")
+}
+
+// load resolves the executables in names relative to dir and verifies them,
+// returning every missing or mismatching executable in one error. Unless
+// releaseChecked, every executable needs a Version or Revision to check.
+func (m prebuiltManifest) load(dir string, names []string, releaseChecked bool) (world.BuiltExecutables, error) {
+	executables := world.BuiltExecutables{}
+	problems := []string{}
+
+	for _, name := range names {
+		executable, ok := m.Executables[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not in the manifest", name))
+			continue
+		}
+		if !releaseChecked && executable.Version == "" && executable.Revision == "" {
+			problems = append(problems, fmt.Sprintf("%s: the manifest has no version or revision to check", name))
+			continue
+		}
+
+		path := executable.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		err := executable.verify(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		executables[name] = path
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("prebuilt executables in %s:\n  %s", dir, strings.Join(problems, "\n  "))
+	}
+	return executables, nil
+}
+
+func (e prebuiltExecutable) verify(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+
+	if e.Version == "" && e.Revision == "" {
+		return nil
+	}
+
+	build, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading build info of %s: %s", path, err)
+	}
+
+	if e.Version != "" {
+		version, err := moduleVersion(build, e.Module)
+		if err != nil {
+			return err
+		}
+		if version != e.Version {
+			return fmt.Errorf("%s was built from %s %s, the manifest expects %s", path, moduleName(build, e.Module), version, e.Version)
+		}
+	}
+
+	if e.Revision != "" {
+		revision := ""
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+		if !strings.HasPrefix(revision, e.Revision) {
+			return fmt.Errorf("%s was built from revision %q, the manifest expects %s", path, revision, e.Revision)
+		}
+	}
+
+	return nil
+}
+
+func moduleVersion(build *buildinfo.BuildInfo, module string) (string, error) {
+	if module == "" || module == build.Main.Path {
+		return build.Main.Version, nil
+	}
+	for _, dep := range build.Deps {
+		if dep.Path == module {
+			if dep.Replace != nil {
+				return dep.Replace.Version, nil
+			}
+			return dep.Version, nil
+		}
+	}
+	return "", errors.New(module + " is not a module of " + build.Path)
+}
+
+func moduleName(build *buildinfo.BuildInfo, module string) string {
+	if module == "" {
+		return build.Main.Path
+	}
+	return module
+}
+
+// usePrebuiltExecutables removes the jobs building into binariesPath when
+// DUSTS_PREBUILT_BINARIES plus envSuffix is set and loads the executables
+// they would have built for release instead.
+func usePrebuiltExecutables(jobs []buildJob, binariesPath, envSuffix, release string) ([]buildJob, world.BuiltExecutables, error) {
+	path := prebuiltPath(envSuffix)
+	if path == "" {
+		return jobs, nil, nil
+	}
+
+	remaining := []buildJob{}
+	names := []string{}
+	for _, job := range jobs {
+		if job.BinariesPath == binariesPath {
+			names = append(names, job.Executable)
+		} else {
+			remaining = append(remaining, job)
+		}
+	}
+
+	fmt.Printf("Using prebuilt executables from %s instead of building into %s\n", path, binariesPath)
+	executables, err := loadPrebuiltExecutables(path, names, release)
+	return remaining, executables, err
+}
@@ -0,0 +1,163 @@
+package dusts_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/inigo/world"
+)
+
+// preflight collects every problem with the environment of the suite so
+// that they are reported at once, before anything is compiled.
+type preflight struct {
+	problems []string
+}
+
+func (p *preflight) problemf(format string, args ...interface{}) {
+	p.problems = append(p.problems, fmt.Sprintf(format, args...))
+}
+
+// require records a problem if the setting name has no value.
+func (p *preflight) require(name, value string) string {
+	if value == "" {
+		p.problemf("%s not set", name)
+	}
+	return value
+}
+
+// requireDir records a problem unless path is a directory.
+func (p *preflight) requireDir(description, path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		p.problemf("%s: %s", description, err)
+		return false
+	}
+	if !info.IsDir() {
+		p.problemf("%s: %s is not a directory", description, path)
+		return false
+	}
+	return true
+}
+
+// checkBuildJobs checks that the source of every job is where the build
+// expects it: GOPATH builds need the package under src/, module builds a
+// go.mod, and relative packages their directory in the module.
+func (p *preflight) checkBuildJobs(jobs []buildJob) {
+	for _, job := range jobs {
+		description := fmt.Sprintf("%s for %s", job.Executable, job.BinariesPath)
+		if job.SourceDir == "" {
+			p.problemf("%s: source directory not set", description)
+			continue
+		}
+		if !p.requireDir(description, job.SourceDir) {
+			continue
+		}
+
+		switch {
+		case job.Gopath:
+			p.requireDir(description, filepath.Join(job.SourceDir, "src", job.Package))
+		case strings.HasPrefix(job.Package, "./"):
+			p.requireDir(description, filepath.Join(job.SourceDir, job.Package))
+		default:
+			if _, err := os.Stat(filepath.Join(job.SourceDir, "go.mod")); err != nil {
+				p.problemf("%s: %s is not a go module: %s", description, job.SourceDir, err)
+			}
+		}
+	}
+}
+
+// checkVizzini checks that vizzini can be run from the GOPATH in envVar.
+func (p *preflight) checkVizzini(envVar string) {
+	gopath := p.require(envVar, suite.Gopath(envVar))
+	if gopath != "" {
+		p.requireDir("vizzini in "+envVar, filepath.Join(gopath, "src/code.cloudfoundry.org/vizzini"))
+	}
+}
+
+func (p *preflight) checkTool(name string) {
+	if _, err := exec.LookPath(name); err != nil {
+		p.problemf("%s not found in PATH", name)
+	}
+}
+
+// checkGrootFSStore checks what ComponentMakerV1.GrootFSInitStore needs to
+// create the grootfs store: the grootfs and tardis binaries in
+// GROOTFS_BINPATH, a GROOTFS_STORE_PATH it can create, mkfs.xfs for the
+// backing file of the store, and root to mount it.
+func (p *preflight) checkGrootFSStore() {
+	binPath := p.require("GROOTFS_BINPATH", os.Getenv("GROOTFS_BINPATH"))
+	if binPath != "" && p.requireDir("GROOTFS_BINPATH", binPath) {
+		for _, name := range []string{"grootfs", "tardis"} {
+			info, err := os.Stat(filepath.Join(binPath, name))
+			if err != nil || info.Mode()&0111 == 0 {
+				p.problemf("GROOTFS_BINPATH: no %s executable in %s", name, binPath)
+			}
+		}
+	}
+
+	storePath := p.require("GROOTFS_STORE_PATH", os.Getenv("GROOTFS_STORE_PATH"))
+	if storePath != "" {
+		p.requireDir("GROOTFS_STORE_PATH", filepath.Dir(storePath))
+	}
+
+	p.checkTool("mkfs.xfs")
+	if os.Geteuid() != 0 {
+		p.problemf("the grootfs store can only be initialized as root")
+	}
+}
+
+// checkDB checks that the SQL server from world.DBInfo accepts connections.
+func (p *preflight) checkDB() {
+	driver, connectionString := world.DBInfo()
+	address, err := dbAddress(driver, connectionString)
+	if err != nil {
+		p.problemf("database: %s", err)
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		p.problemf("%s database at %s is not reachable: %s", driver, address, err)
+		return
+	}
+	conn.Close()
+}
+
+var mysqlAddress = regexp.MustCompile(`@tcp\(([^)]+)\)`)
+
+func dbAddress(driver, connectionString string) (string, error) {
+	switch driver {
+	case "mysql":
+		match := mysqlAddress.FindStringSubmatch(connectionString)
+		if match == nil {
+			return "", fmt.Errorf("no tcp address in %q", connectionString)
+		}
+		return match[1], nil
+	case "postgres":
+		u, err := url.Parse(connectionString)
+		if err != nil {
+			return "", err
+		}
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), "5432"), nil
+		}
+		return u.Host, nil
+	default:
+		return "", fmt.Errorf("unknown driver %q", driver)
+	}
+}
+
+func (p *preflight) Err() error {
+	if len(p.problems) == 0 {
+		return nil
+	}
+	return errors.New("the environment is not set up to run the suite:\n  " + strings.Join(p.problems, "\n  "))
+}
@@ -0,0 +1,210 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// suiteReport collects one specReport per RollingUpgrade spec and is written
+// as JSON and JUnit XML next to the component logs.
+var suiteReport = &upgradeReport{}
+
+type upgradeReport struct {
+	mu    sync.Mutex
+	Specs []specReport `json:"specs"`
+}
+
+type specReport struct {
+	Name             string            `json:"name"`
+	V0Version        string            `json:"v0_version"`
+	Start            time.Time         `json:"start"`
+	End              time.Time         `json:"end"`
+	InitialVersions  map[string]string `json:"initial_versions"`
+	Steps            []stepReport      `json:"steps"`
+	Pollers          []PollerStats     `json:"pollers"`
+	Instances        []instanceStats   `json:"instances"`
+	SSHSessions      []heldSession     `json:"ssh_sessions,omitempty"`
+	Tasks            *taskChurnReport  `json:"tasks,omitempty"`
+	UpgradeOrder     []string          `json:"upgrade_order,omitempty"`
+	UpgradeOrderSeed int64             `json:"upgrade_order_seed,omitempty"`
+	Failed           bool              `json:"failed"`
+	Failure          *failureRecord    `json:"failure,omitempty"`
+}
+
+type stepReport struct {
+	stepRecord
+	Pollers   []PollerStats   `json:"pollers,omitempty"`
+	Instances []instanceStats `json:"instances,omitempty"`
+}
+
+type failureRecord struct {
+	Message string    `json:"message"`
+	Step    string    `json:"step"`
+	Time    time.Time `json:"time"`
+}
+
+var (
+	failureMu   sync.Mutex
+	specFailure *failureRecord
+)
+
+// recordFailure is registered as the suite's fail handler so the report can
+// include the cause of a failure and the step it happened in.
+func recordFailure(message string, callerSkip ...int) {
+	failureMu.Lock()
+	if specFailure == nil {
+		specFailure = &failureRecord{Message: message, Step: upgradeSteps.Current(), Time: time.Now()}
+	}
+	failureMu.Unlock()
+
+	skip := 1
+	if len(callerSkip) > 0 {
+		skip += callerSkip[0]
+	}
+	Fail(message, skip)
+}
+
+func resetFailure() {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+	specFailure = nil
+}
+
+func currentFailure() *failureRecord {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+	return specFailure
+}
+
+func (r *upgradeReport) Add(spec specReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Specs = append(r.Specs, spec)
+}
+
+// Write replaces <basePath>.report.json and <basePath>.report.xml with the
+// specs reported so far.
+func (r *upgradeReport) Write(basePath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jsonReport, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(basePath+".report.json", jsonReport, 0644)
+	if err != nil {
+		return err
+	}
+
+	xmlReport, err := xml.MarshalIndent(r.junit(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(basePath+".report.xml", append([]byte(xml.Header), xmlReport...), 0644)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message  string `xml:"message,attr"`
+	Type     string `xml:"type,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// junit reports every step of a spec as a test case. A failure is attached
+// to the step it happened in, or to an extra test case named after the spec
+// when it happened outside of any step.
+func (r *upgradeReport) junit() junitTestSuites {
+	suites := junitTestSuites{}
+
+	for _, spec := range r.Specs {
+		suite := junitTestSuite{
+			Name:      spec.Name,
+			Time:      spec.End.Sub(spec.Start).Seconds(),
+			Timestamp: spec.Start.Format(time.RFC3339),
+		}
+
+		failureReported := false
+		for _, step := range spec.Steps {
+			testCase := junitTestCase{
+				Name:      step.Name,
+				ClassName: spec.Name,
+				Time:      step.End.Sub(step.Start).Seconds(),
+				SystemOut: step.summary(),
+			}
+
+			if f := spec.Failure; f != nil && !failureReported && f.Step == step.Name && !f.Time.Before(step.Start) && (step.End.IsZero() || f.Time.Before(step.End)) {
+				testCase.Failure = &junitFailure{Message: firstLine(f.Message), Type: "Failure", Contents: f.Message}
+				failureReported = true
+			}
+
+			suite.TestCases = append(suite.TestCases, testCase)
+		}
+
+		if spec.Failed && !failureReported {
+			testCase := junitTestCase{Name: spec.Name, ClassName: spec.Name, Time: suite.Time}
+			message := "spec failed"
+			if spec.Failure != nil {
+				message = spec.Failure.Message
+			}
+			testCase.Failure = &junitFailure{Message: firstLine(message), Type: "Failure", Contents: message}
+			suite.TestCases = append(suite.TestCases, testCase)
+		}
+
+		suite.Tests = len(suite.TestCases)
+		if spec.Failed {
+			suite.Failures = 1
+		}
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	return suites
+}
+
+func (s stepReport) summary() string {
+	lines := []string{}
+	for instance, version := range s.Versions {
+		lines = append(lines, fmt.Sprintf("%s: %s", instance, version))
+	}
+	sort.Strings(lines)
+	for _, stats := range s.Pollers {
+		lines = append(lines, stats.String())
+	}
+	for _, stats := range s.Instances {
+		lines = append(lines, stats.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(strings.TrimSpace(s), "\n", 2)[0]
+}
@@ -1,11 +1,15 @@
 package dusts_test
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
-	"code.cloudfoundry.org/bbs/models"
 	"code.cloudfoundry.org/guardian/gqt/runner"
 	"code.cloudfoundry.org/inigo/fixtures"
 	"code.cloudfoundry.org/inigo/helpers"
@@ -21,55 +25,122 @@ import (
 )
 
 var _ = Describe("RollingUpgrade", func() {
+	// dockerRootFS is the image of the docker canary in the registry started
+	// by setupPlumbing.
+	var dockerRootFS string
 
-	setupPlumbing := func() ifrit.Process {
-		fileServer, fileServerAssetsDir := ComponentMakerV1.FileServer()
+	// setupPlumbing starts the V1 file server unless the upgrade plan starts
+	// one of its own. Either way it serves the assets in fileServerAssets.
+	setupPlumbing := func(withFileServer bool) ifrit.Process {
+		fileServerAssets = world.TempDirWithParent(suiteTempDir, "file-server-assets")
 
 		archiveFiles := fixtures.GoServerApp()
 		archive_helper.CreateZipArchive(
-			filepath.Join(fileServerAssetsDir, "lrp.zip"),
+			filepath.Join(fileServerAssets, "lrp.zip"),
 			archiveFiles,
 		)
 
-		return ginkgomon.Invoke(grouper.NewParallel(os.Kill, grouper.Members{
+		lifecycle, err := ioutil.ReadFile(oldArtifacts.Lifecycles["dockerapplifecycle"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(fileServerAssets, dockerLifecycleAsset), lifecycle, 0644)).To(Succeed())
+		addSSHDAsset(fileServerAssets)
+
+		imageLayoutDir := world.TempDirWithParent(suiteTempDir, "oci-image")
+		Expect(writeGoServerImage(imageLayoutDir, archiveFiles)).To(Succeed())
+		registryPort, err := allocator.ClaimPorts(1)
+		Expect(err).NotTo(HaveOccurred())
+		registryAddr := fmt.Sprintf("127.0.0.1:%d", registryPort)
+		dockerRootFS = fmt.Sprintf("docker://%s/%s#%s", registryAddr, dockerCanaryImage, dockerCanaryTag)
+
+		// Every later release can emit TCP routes if V0 can, so the TCP
+		// routing tier is only left out for releases older than that.
+		if v0Release.EmitsTCPRoutes {
+			tcpRoutes, err = newTCPRouting(logger)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		members := grouper.Members{
 			{Name: "nats", Runner: ComponentMakerV1.NATS()},
 			{Name: "sql", Runner: ComponentMakerV1.SQL()},
 			{Name: "consul", Runner: ComponentMakerV1.Consul()},
-			{Name: "file-server", Runner: fileServer},
+			{Name: "docker-registry", Runner: newOCIRegistry(registryAddr, imageLayoutDir, dockerCanaryImage)},
 			{Name: "garden", Runner: ComponentMakerV1.Garden(func(cfg *runner.GdnRunnerConfig) {
 				poolSize := 100
 				cfg.PortPoolSize = &poolSize
+				Expect(trustRegistryInGrootFS(cfg, registryAddr)).To(Succeed())
 			})},
 			{Name: "router", Runner: ComponentMakerV1.Router()},
-		}))
+		}
+		if withFileServer {
+			fileServer, fileServerAssetsDir := ComponentMakerV1.FileServer()
+			Expect(copyAssets(fileServerAssets, fileServerAssetsDir)).To(Succeed())
+			members = append(members, grouper.Member{Name: "file-server", Runner: fileServer})
+		}
+
+		ordered := grouper.Members{
+			{Name: "plumbing", Runner: grouper.NewParallel(os.Kill, members)},
+		}
+		if tcpRoutes != nil {
+			// routing-api needs the database to be up.
+			ordered = append(ordered, grouper.Member{Name: "tcp-routing", Runner: tcpRoutes.Runner()})
+		}
+		return ginkgomon.Invoke(grouper.NewOrdered(os.Kill, ordered))
 	}
 
 	Context("rolling upgrade v0 to v1", func() {
 		var (
-			canaryPoller ifrit.Process
+			canaries     *canarySet
+			tasks        *taskChurn
+			taskReport   *taskChurnReport
+			taskServer   ifrit.Process
+			taskChurning ifrit.Process
 			plumbing     ifrit.Process
+			// sshProxy is whether the plan starts an ssh-proxy for the SSH
+			// canary to go through.
+			sshProxy  bool
+			specStart time.Time
+			// currentOrder is the order of the first plan the spec runs, nil
+			// for the plan's own.
+			currentOrder *upgradeOrder
 		)
 
 		BeforeEach(func() {
 			GinkgoWriter = io.MultiWriter(GinkgoWriter, componentLogs)
 
-			diegoV0Version := os.Getenv("DIEGO_VERSION_V0")
-
-			switch diegoV0Version {
-			case diegoGAVersion:
-				ComponentMakerV0 = world.MakeV0ComponentMaker(oldArtifacts, addresses, allocator, certAuthority)
-				ComponentMakerV0.Setup()
-				upgrader = NewGAUpgrader()
-			case diegoLocketLocalREVersion:
-				ComponentMakerV0 = world.MakeComponentMaker(oldArtifacts, addresses, allocator, certAuthority)
-				ComponentMakerV0.Setup()
-				upgrader = NewLocketLocalREUpgrader()
+			specStart = time.Now()
+			resetFailure()
+			upgradeSteps.Reset(nil)
+			canaries = nil
+			tasks, taskReport, taskServer, taskChurning = nil, nil, nil, nil
+			currentOrder = nil
+
+			ComponentMakerV0 = v0Release.MakeComponentMaker(oldArtifacts, addresses, allocator, certAuthority)
+			ComponentMakerV0.Setup()
+
+			IntermediateComponentMakers = nil
+			for i, release := range intermediateReleases {
+				maker := release.MakeComponentMaker(intermediateArtifacts[i], addresses, allocator, certAuthority)
+				maker.Setup()
+				IntermediateComponentMakers = append(IntermediateComponentMakers, maker)
 			}
 
+			hops := []*UpgradePlan{}
+			for i, release := range append([]*diegoRelease{v0Release}, intermediateReleases...) {
+				planPath := release.UpgradePlan
+				if override := suite.UpgradePlan; override != "" && i == 0 {
+					planPath = override
+				}
+				plan, err := LoadUpgradePlan(planPath)
+				Expect(err).NotTo(HaveOccurred())
+				hops = append(hops, plan)
+			}
+			upgrader = NewPlanUpgrader(hops...)
+			sshProxy = hops[0].Starts(componentSSHProxy)
+
 			logger = lager.NewLogger("test")
 			logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.DEBUG))
 
-			plumbing = setupPlumbing()
+			plumbing = setupPlumbing(!hops[0].Starts(componentFileServer))
 			helpers.ConsulWaitUntilReady(ComponentMakerV0.Addresses())
 
 			upgrader.StartUp()
@@ -77,32 +148,192 @@ var _ = Describe("RollingUpgrade", func() {
 			bbsClient = ComponentMakerV0.BBSClient()
 		})
 
+		// writeReport adds the spec to the upgrade report.
+		writeReport := func() {
+			spec := specReport{
+				Name:            CurrentGinkgoTestDescription().FullTestText,
+				V0Version:       v0Release.Version,
+				Start:           specStart,
+				End:             time.Now(),
+				InitialVersions: upgradeSteps.InitialVersions(),
+				Failed:          CurrentGinkgoTestDescription().Failed || currentFailure() != nil,
+				Failure:         currentFailure(),
+			}
+			for _, step := range upgradeSteps.Steps() {
+				report := stepReport{stepRecord: step}
+				if canaries != nil {
+					report.Pollers = canaries.RouteStatsBetween(step.Name, step.Start, step.End)
+					report.Instances = canaries.InstanceStatsBetween(step.Name, step.Start, step.End)
+				}
+				spec.Steps = append(spec.Steps, report)
+			}
+			if canaries != nil {
+				spec.Pollers = canaries.RouteStatsByStep()
+				spec.Instances = canaries.InstanceStatsByStep()
+				spec.SSHSessions = canaries.SSHSessions()
+			}
+			spec.Tasks = taskReport
+			if currentOrder != nil {
+				spec.UpgradeOrder = currentOrder.Batches
+				spec.UpgradeOrderSeed = currentOrder.Seed
+				if spec.Failed {
+					fmt.Fprintf(GinkgoWriter, "Failed upgrading in %s: %s\n", currentOrder.Name(), currentOrder)
+					env := "DUSTS_UPGRADE_ORDERS=" + suite.UpgradeOrders
+					if currentOrder.Seed != 0 {
+						env += fmt.Sprintf(" DUSTS_UPGRADE_ORDER_SEED=%d", currentOrder.Seed)
+					}
+					fmt.Fprintf(GinkgoWriter, "Rerun it with %s -focus=%q\n", env, regexp.QuoteMeta(currentOrder.Name())+"$")
+				}
+			}
+			suiteReport.Add(spec)
+
+			reportPath := strings.TrimSuffix(componentLogPath, ".log")
+			Expect(suiteReport.Write(reportPath)).To(Succeed())
+			fmt.Fprintf(GinkgoWriter, "Wrote upgrade report to %s.report.{json,xml}\n", reportPath)
+		}
+
 		AfterEach(func() {
+			upgradeSteps.Finish()
+			componentLogFiles.MarkUpgraded(CurrentGinkgoTestDescription().FullTestText)
+			// The report is written last so that it includes the failures of
+			// the cleanup and of the component log checks.
+			defer writeReport()
+
+			if tasks != nil && taskReport == nil {
+				report := tasks.Reconcile()
+				taskReport = &report
+			}
+
 			destroyContainerErrors := helpers.CleanupGarden(ComponentMakerV1.GardenClient())
 
 			upgrader.ShutDown()
-			helpers.StopProcesses(canaryPoller, plumbing)
+			if canaries != nil {
+				helpers.StopProcesses(canaries.Processes()...)
+			}
+			if taskChurning != nil {
+				helpers.StopProcesses(taskChurning, taskServer)
+			}
+			helpers.StopProcesses(plumbing)
+			tcpRoutes = nil
 
 			Expect(destroyContainerErrors).To(
 				BeEmpty(),
 				"%d containers failed to be destroyed!",
 				len(destroyContainerErrors),
 			)
+
+			By("checking component logs for unexpected errors")
+			allowlist, err := loadLogAllowlist(logAllowlistPath)
+			Expect(err).NotTo(HaveOccurred())
+			componentErrors, err := analyzeComponentLogs(componentLogFiles, CurrentGinkgoTestDescription().FullTestText)
+			Expect(err).NotTo(HaveOccurred())
+			unexpected := allowlist.Unexpected(componentErrors)
+			Expect(unexpected).To(BeEmpty(), "components logged errors not in %s:\n%s", logAllowlistPath, formatComponentErrors(unexpected))
 		})
 
-		It("should consistently remain routable", func() {
-			canary := helpers.DefaultLRPCreateRequest(ComponentMakerV0.Addresses(), "dust-canary", "dust-canary", 1)
-			err := bbsClient.DesireLRP(logger, canary)
+		startCanary := func() {
+			cells, err := bbsClient.Cells(logger)
 			Expect(err).NotTo(HaveOccurred())
-			Eventually(helpers.LRPStatePoller(logger, bbsClient, canary.ProcessGuid, nil)).Should(Equal(models.ActualLRPStateRunning))
 
-			canaryPoller = ifrit.Background(NewPoller(logger, ComponentMakerV0.Addresses().Router, helpers.DefaultHost))
-			Eventually(canaryPoller.Ready()).Should(BeClosed())
+			canaries, err = newCanarySet(cells, dockerRootFS, tcpRoutes, sshProxy)
+			Expect(err).NotTo(HaveOccurred())
+			canaries.Start()
+		}
+
+		verifyCanaryBudget := func() {
+			Expect(canaries.Verify()).To(Succeed())
+		}
+
+		startTaskChurn := func() {
+			port, err := allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+			callbackAddr := fmt.Sprintf("127.0.0.1:%d", port)
+
+			tasks = newTaskChurn(logger, callbackAddr, taskRootFS())
+			taskServer = ginkgomon.Invoke(tasks.CallbackServer(callbackAddr))
+			taskChurning = ginkgomon.Invoke(tasks)
+		}
+
+		verifyTaskChurn := func() {
+			helpers.StopProcesses(taskChurning)
+			tasks.Settle()
+
+			report := tasks.Reconcile()
+			taskReport = &report
+			fmt.Fprintln(GinkgoWriter, report)
+			Expect(report.Verify()).To(Succeed())
+		}
+
+		It("should consistently remain routable", func() {
+			startCanary()
+			startTaskChurn()
 
 			upgrader.RollingUpgrade()
 
-			By("checking poller is still up")
-			Consistently(canaryPoller.Wait()).ShouldNot(Receive())
+			By("checking the canaries stayed within their availability budget")
+			verifyCanaryBudget()
+
+			By("reconciling every task desired during the upgrade")
+			verifyTaskChurn()
+		})
+
+		It("should consistently remain routable when rolled back to v0", func() {
+			startCanary()
+			startTaskChurn()
+
+			upgrader.RollingUpgrade()
+
+			upgrader.Rollback()
+
+			By("checking the canaries stayed within their availability budget")
+			verifyCanaryBudget()
+
+			By("reconciling every task desired during the upgrade")
+			verifyTaskChurn()
 		})
+
+		for _, planPath := range scenarioPlans() {
+			planPath := planPath
+
+			Context("running "+strings.TrimSuffix(filepath.Base(planPath), ".json"), func() {
+				It("should consistently remain routable", func() {
+					plan, err := LoadUpgradePlan(planPath)
+					Expect(err).NotTo(HaveOccurred())
+					upgrader.Reorder(plan)
+
+					startCanary()
+					startTaskChurn()
+
+					upgrader.RollingUpgrade()
+
+					By("checking the canaries stayed within their availability budget")
+					verifyCanaryBudget()
+
+					By("reconciling every task desired during the upgrade")
+					verifyTaskChurn()
+				})
+			})
+		}
+
+		for _, order := range upgradeOrders {
+			order := order
+
+			It("should consistently remain routable upgrading in "+order.Name(), func() {
+				currentOrder = &order
+				By("upgrading in " + order.String())
+				upgrader.Reorder(order.Plan)
+
+				startCanary()
+				startTaskChurn()
+
+				upgrader.RollingUpgrade()
+
+				By("checking the canaries stayed within their availability budget")
+				verifyCanaryBudget()
+
+				By("reconciling every task desired during the upgrade")
+				verifyTaskChurn()
+			})
+		}
 	})
 })
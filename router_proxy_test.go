@@ -0,0 +1,48 @@
+package dusts_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("checkRouterProxy", func() {
+	var (
+		server *httptest.Server
+		hosts  chan string
+	)
+
+	serve := func(header string) {
+		hosts = make(chan string, 1)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			if header != "" {
+				w.Header().Set("X-Cf-Routererror", header)
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+	}
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("accepts a proxy answered by the router", func() {
+		serve("unknown_route")
+		Expect(checkRouterProxy(server.URL)).To(Succeed())
+		Expect(hosts).To(Receive(Equal("dusts-proxy-check.test.internal")))
+	})
+
+	It("rejects a proxy that is not the router", func() {
+		serve("")
+		Expect(checkRouterProxy(server.URL)).To(MatchError(ContainSubstring("answered with 404 Not Found, not the router")))
+	})
+
+	It("rejects a proxy nothing listens on", func() {
+		serve("")
+		server.Close()
+		Expect(checkRouterProxy(server.URL)).To(MatchError(ContainSubstring("vizzini cannot reach the router")))
+	})
+})
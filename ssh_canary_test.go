@@ -0,0 +1,326 @@
+package dusts_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	archive_helper "code.cloudfoundry.org/archiver/extractor/test_helper"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/diego-ssh/keys"
+	"code.cloudfoundry.org/diego-ssh/routes"
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshCredentials is the password ssh-proxy expects for diego:<guid>/<index>
+	// users, set on every ssh-proxy by the diego-ssh-auth mutator.
+	sshCredentials   = "dusts-ssh"
+	sshContainerPort = 2222
+	sshdAsset        = "sshd.tgz"
+	sshTimeout       = 10 * time.Second
+	heldSessionTick  = 200 * time.Millisecond
+)
+
+// sessionStallTimeout is how long a held session may go without output
+// before it is considered hung rather than alive or closed.
+var sessionStallTimeout = 10 * time.Second
+
+// sshBudget only bounds how long new sessions may fail: an SSH handshake
+// through the proxy is too slow for the latency budget of HTTP routes.
+var sshBudget = availabilityBudget{
+	MaxUnavailable: time.Duration(suite.Poller.MaxUnavailable),
+}
+
+// addSSHDAsset puts the sshd built for V1 on the file server as a tarball
+// the SSH canary downloads into its containers.
+func addSSHDAsset(fileServerAssetsDir string) {
+	sshd, err := ioutil.ReadFile(newArtifacts.Executables["sshd"])
+	Expect(err).NotTo(HaveOccurred())
+	archive_helper.CreateTarGZArchive(filepath.Join(fileServerAssetsDir, sshdAsset), []archive_helper.ArchiveFile{
+		{Name: "sshd", Body: string(sshd), Mode: 0755},
+	})
+}
+
+// useSSHD runs sshd next to the app, with a fresh host key and an
+// authorized key whose private half ssh-proxy gets through the diego-ssh
+// route of the LRP, the way Cloud Controller desires apps with SSH enabled.
+func useSSHD(lrp *models.DesiredLRP) {
+	hostKey, err := keys.RSAKeyPairFactory.NewKeyPair(1024)
+	Expect(err).NotTo(HaveOccurred())
+	userKey, err := keys.RSAKeyPairFactory.NewKeyPair(1024)
+	Expect(err).NotTo(HaveOccurred())
+
+	lrp.Setup = models.WrapAction(models.Serial(
+		models.UnwrapAction(lrp.Setup),
+		&models.DownloadAction{
+			User:     "vcap",
+			From:     fmt.Sprintf("http://%s/v1/static/%s", ComponentMakerV0.Addresses().FileServer, sshdAsset),
+			To:       "/tmp/ssh",
+			CacheKey: "dusts-sshd",
+		},
+	))
+	lrp.Action = models.WrapAction(models.Parallel(
+		models.UnwrapAction(lrp.Action),
+		&models.RunAction{
+			User: "vcap",
+			Path: "/tmp/ssh/sshd",
+			Args: []string{
+				fmt.Sprintf("-address=0.0.0.0:%d", sshContainerPort),
+				"-hostKey=" + hostKey.PEMEncodedPrivateKey(),
+				"-authorizedKey=" + userKey.AuthorizedKey(),
+				"-inheritDaemonEnv",
+				"-logLevel=debug",
+			},
+		},
+	))
+	lrp.Ports = append(lrp.Ports, sshContainerPort)
+
+	sshRoute, err := json.Marshal(routes.SSHRoute{
+		ContainerPort:   sshContainerPort,
+		PrivateKey:      userKey.PEMEncodedPrivateKey(),
+		HostFingerprint: hostKey.Fingerprint(),
+	})
+	Expect(err).NotTo(HaveOccurred())
+	sshRouteMessage := json.RawMessage(sshRoute)
+	(*lrp.Routes)[routes.DIEGO_SSH] = &sshRouteMessage
+}
+
+func sshClientConfig(processGuid string, index int) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            fmt.Sprintf("diego:%s/%d", processGuid, index),
+		Auth:            []ssh.AuthMethod{ssh.Password(sshCredentials)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         sshTimeout,
+	}
+}
+
+// NewSSHPoller opens a new session through ssh-proxy for every request and
+// runs a command in it.
+func NewSSHPoller(logger lager.Logger, proxyAddr, processGuid string, index int) *poller {
+	config := sshClientConfig(processGuid, index)
+	return &poller{
+		logger: logger,
+		route:  fmt.Sprintf("ssh://%s@%s", config.User, proxyAddr),
+		probe: func() (int, error) {
+			client, err := ssh.Dial("tcp", proxyAddr, config)
+			if err != nil {
+				return 0, err
+			}
+			defer client.Close()
+
+			session, err := client.NewSession()
+			if err != nil {
+				return 0, err
+			}
+			defer session.Close()
+
+			output, err := session.Output("echo dusts")
+			if err != nil {
+				return 0, err
+			}
+			if strings.TrimSpace(string(output)) != "dusts" {
+				return 0, fmt.Errorf("unexpected output %q", output)
+			}
+			return 200, nil
+		},
+	}
+}
+
+// heldSession is one long-lived session of the SSH canary.
+type heldSession struct {
+	Opened     time.Time `json:"opened"`
+	OpenedStep string    `json:"opened_step"`
+	Closed     time.Time `json:"closed"`
+	ClosedStep string    `json:"closed_step"`
+	// Steps lists every upgrade step the session was open during.
+	Steps []string `json:"steps"`
+	Err   string   `json:"error,omitempty"`
+	// Hung is set when the session stopped producing output without being
+	// closed for sessionStallTimeout.
+	Hung bool `json:"hung"`
+}
+
+func (s heldSession) String() string {
+	outcome := "still open at the end"
+	if s.Hung {
+		outcome = "hung"
+	} else if s.Err != "" {
+		outcome = "failed: " + s.Err
+	}
+	return fmt.Sprintf("session opened during %q, open through %s, %s during %q", s.OpenedStep, strings.Join(s.Steps, ", "), outcome, s.ClosedStep)
+}
+
+// sessionHolder keeps a session open through ssh-proxy that prints a line
+// every 200ms, replacing it whenever it ends. A session ending when its
+// instance or ssh-proxy goes away is expected; one that stops producing
+// output without ending is not.
+type sessionHolder struct {
+	logger    lager.Logger
+	proxyAddr string
+	config    *ssh.ClientConfig
+
+	mu       sync.Mutex
+	sessions []heldSession
+}
+
+func newSessionHolder(logger lager.Logger, proxyAddr, processGuid string, index int) *sessionHolder {
+	return &sessionHolder{
+		logger:    logger.Session("ssh-session-holder"),
+		proxyAddr: proxyAddr,
+		config:    sshClientConfig(processGuid, index),
+	}
+}
+
+func (h *sessionHolder) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		default:
+		}
+
+		if h.hold(signals) {
+			return nil
+		}
+
+		select {
+		case <-signals:
+			return nil
+		case <-time.After(failureBackoff):
+		}
+	}
+}
+
+// hold opens a session and watches it until it ends, hangs or the holder is
+// signalled, which it reports by returning true. Run waits failureBackoff
+// before opening the next session.
+func (h *sessionHolder) hold(signals <-chan os.Signal) bool {
+	client, err := ssh.Dial("tcp", h.proxyAddr, h.config)
+	if err != nil {
+		h.logger.Info("failed-to-open-session", lager.Data{"error": err.Error()})
+		return false
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		h.logger.Info("failed-to-open-session", lager.Data{"error": err.Error()})
+		return false
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return false
+	}
+	err = session.Start("while true; do echo tick; sleep 0.2; done")
+	if err != nil {
+		h.logger.Info("failed-to-start-command", lager.Data{"error": err.Error()})
+		return false
+	}
+
+	record := heldSession{Opened: time.Now(), OpenedStep: upgradeSteps.Current()}
+	record.Steps = []string{record.OpenedStep}
+
+	var outputMu sync.Mutex
+	lastOutput := time.Now()
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			outputMu.Lock()
+			lastOutput = time.Now()
+			outputMu.Unlock()
+		}
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- session.Wait()
+	}()
+
+	ticker := time.NewTicker(heldSessionTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+			h.finish(record)
+			return true
+
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("exited")
+			}
+			record.Err = err.Error()
+			h.finish(record)
+			return false
+
+		case <-ticker.C:
+			if step := upgradeSteps.Current(); step != record.Steps[len(record.Steps)-1] {
+				record.Steps = append(record.Steps, step)
+			}
+
+			outputMu.Lock()
+			stalled := time.Since(lastOutput)
+			outputMu.Unlock()
+			if stalled > sessionStallTimeout {
+				record.Hung = true
+				record.Err = fmt.Sprintf("no output for %s", stalled)
+				h.finish(record)
+				return false
+			}
+		}
+	}
+}
+
+func (h *sessionHolder) finish(record heldSession) {
+	record.Closed = time.Now()
+	record.ClosedStep = upgradeSteps.Current()
+	h.logger.Info("session-ended", lager.Data{"session": record.String()})
+
+	h.mu.Lock()
+	h.sessions = append(h.sessions, record)
+	h.mu.Unlock()
+}
+
+// Sessions returns every session that ended.
+func (h *sessionHolder) Sessions() []heldSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]heldSession{}, h.sessions...)
+}
+
+// Verify fails on every session that hung.
+func (h *sessionHolder) Verify() error {
+	hung := []string{}
+	for _, session := range h.Sessions() {
+		if session.Hung {
+			hung = append(hung, session.String())
+		}
+	}
+	if len(hung) > 0 {
+		return fmt.Errorf("SSH sessions hung instead of surviving or closing:\n%s", strings.Join(hung, "\n"))
+	}
+	return nil
+}
+
+// describeSessions lists every held session, one per line.
+func describeSessions(sessions []heldSession) string {
+	buf := &bytes.Buffer{}
+	for _, session := range sessions {
+		fmt.Fprintln(buf, session)
+	}
+	return buf.String()
+}
@@ -0,0 +1,271 @@
+package dusts_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/diego-ssh/keys"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHProxy accepts diego:canary/0 with the dusts credentials and runs
+// every command it is sent with run.
+type fakeSSHProxy struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	run      func(command string, channel ssh.Channel, done <-chan struct{})
+	done     chan struct{}
+}
+
+func newFakeSSHProxy(run func(command string, channel ssh.Channel, done <-chan struct{})) *fakeSSHProxy {
+	hostKey, err := keys.RSAKeyPairFactory.NewKeyPair(1024)
+	Expect(err).NotTo(HaveOccurred())
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(metadata ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if metadata.User() != "diego:canary/0" || string(password) != sshCredentials {
+				return nil, errors.New("permission denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey.PrivateKey())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	proxy := &fakeSSHProxy{listener: listener, config: config, run: run, done: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.serve(conn)
+		}
+	}()
+	return proxy
+}
+
+func (p *fakeSSHProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *fakeSSHProxy) Close() {
+	close(p.done)
+	p.listener.Close()
+}
+
+func (p *fakeSSHProxy) serve(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, p.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go p.session(channel, requests)
+	}
+}
+
+func (p *fakeSSHProxy) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(request.Payload, &exec); err != nil {
+			request.Reply(false, nil)
+			return
+		}
+		request.Reply(true, nil)
+		p.run(exec.Command, channel, p.done)
+		return
+	}
+}
+
+// exitWith sends the exit status of a command, without which the client
+// reports it as failed.
+func exitWith(channel ssh.Channel, status uint32) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+var _ = Describe("SSH canary", func() {
+	Describe("NewSSHPoller", func() {
+		It("reports a session printing dusts as up", func() {
+			proxy := newFakeSSHProxy(func(command string, channel ssh.Channel, _ <-chan struct{}) {
+				Expect(command).To(Equal("echo dusts"))
+				channel.Write([]byte("dusts\n"))
+				exitWith(channel, 0)
+			})
+			defer proxy.Close()
+
+			status, err := NewSSHPoller(lagertest.NewTestLogger("dusts"), proxy.Addr(), "canary", 0).probe()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(200))
+		})
+
+		It("fails on unexpected output", func() {
+			proxy := newFakeSSHProxy(func(_ string, channel ssh.Channel, _ <-chan struct{}) {
+				channel.Write([]byte("container not found\n"))
+				exitWith(channel, 0)
+			})
+			defer proxy.Close()
+
+			_, err := NewSSHPoller(lagertest.NewTestLogger("dusts"), proxy.Addr(), "canary", 0).probe()
+			Expect(err).To(MatchError(`unexpected output "container not found\n"`))
+		})
+
+		It("fails on a failing command", func() {
+			proxy := newFakeSSHProxy(func(_ string, channel ssh.Channel, _ <-chan struct{}) {
+				exitWith(channel, 1)
+			})
+			defer proxy.Close()
+
+			_, err := NewSSHPoller(lagertest.NewTestLogger("dusts"), proxy.Addr(), "canary", 0).probe()
+			Expect(err).To(BeAssignableToTypeOf(&ssh.ExitError{}))
+		})
+
+		It("fails when ssh-proxy refuses the instance", func() {
+			proxy := newFakeSSHProxy(nil)
+			defer proxy.Close()
+
+			_, err := NewSSHPoller(lagertest.NewTestLogger("dusts"), proxy.Addr(), "canary", 1).probe()
+			Expect(err).To(MatchError(ContainSubstring("unable to authenticate")))
+		})
+
+		It("fails when ssh-proxy is not listening", func() {
+			proxy := newFakeSSHProxy(nil)
+			proxy.Close()
+
+			_, err := NewSSHPoller(lagertest.NewTestLogger("dusts"), proxy.Addr(), "canary", 0).probe()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("sessionHolder", func() {
+		var (
+			savedStallTimeout time.Duration
+			proxy             *fakeSSHProxy
+			holder            *sessionHolder
+			process           ifrit.Process
+		)
+
+		ticking := func(_ string, channel ssh.Channel, done <-chan struct{}) {
+			for {
+				if _, err := channel.Write([]byte("tick\n")); err != nil {
+					return
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+		}
+
+		BeforeEach(func() {
+			process = nil
+			savedStallTimeout = sessionStallTimeout
+			sessionStallTimeout = 500 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			sessionStallTimeout = savedStallTimeout
+			if process != nil {
+				process.Signal(os.Interrupt)
+				Eventually(process.Wait()).Should(Receive())
+			}
+			proxy.Close()
+		})
+
+		startInstance := func(index int, run func(string, ssh.Channel, <-chan struct{})) {
+			proxy = newFakeSSHProxy(run)
+			holder = newSessionHolder(lagertest.NewTestLogger("dusts"), proxy.Addr(), "canary", index)
+			process = ifrit.Invoke(holder)
+		}
+
+		start := func(run func(string, ssh.Channel, <-chan struct{})) {
+			startInstance(0, run)
+		}
+
+		It("keeps a session open until signalled", func() {
+			start(ticking)
+			Consistently(holder.Sessions, sessionStallTimeout+2*heldSessionTick).Should(BeEmpty())
+
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+
+			sessions := holder.Sessions()
+			Expect(sessions).To(HaveLen(1))
+			Expect(sessions[0].Hung).To(BeFalse())
+			Expect(sessions[0].Err).To(BeEmpty())
+			Expect(sessions[0].Steps).To(Equal([]string{sessions[0].OpenedStep}))
+			Expect(holder.Verify()).To(Succeed())
+		})
+
+		It("records a session that ends and opens the next one", func() {
+			start(func(_ string, channel ssh.Channel, _ <-chan struct{}) {
+				channel.Write([]byte("tick\n"))
+				exitWith(channel, 255)
+			})
+
+			Eventually(func() int { return len(holder.Sessions()) }).Should(BeNumerically(">=", 2))
+			for _, session := range holder.Sessions() {
+				Expect(session.Hung).To(BeFalse())
+				Expect(session.Err).To(ContainSubstring("status 255"))
+			}
+			Expect(holder.Verify()).To(Succeed())
+		})
+
+		It("fails a session that stops producing output without ending", func() {
+			start(func(_ string, channel ssh.Channel, done <-chan struct{}) {
+				channel.Write([]byte("tick\n"))
+				<-done
+			})
+
+			Eventually(holder.Sessions, 2*time.Second).ShouldNot(BeEmpty())
+			session := holder.Sessions()[0]
+			Expect(session.Hung).To(BeTrue())
+			Expect(session.Err).To(HavePrefix("no output for "))
+
+			err := holder.Verify()
+			Expect(err).To(MatchError(HavePrefix("SSH sessions hung instead of surviving or closing:\n")))
+			Expect(err).To(MatchError(ContainSubstring(session.String())))
+		})
+
+		It("does not record sessions it could not open", func() {
+			startInstance(1, nil)
+
+			Consistently(holder.Sessions, 3*failureBackoff).Should(BeEmpty())
+		})
+	})
+
+	DescribeTable("heldSession",
+		func(session heldSession, expected string) {
+			session.OpenedStep = "upgrade bbs"
+			session.Steps = []string{"upgrade bbs", "upgrade rep/0"}
+			session.ClosedStep = "upgrade rep/0"
+			Expect(session.String()).To(Equal(`session opened during "upgrade bbs", open through upgrade bbs, upgrade rep/0, ` + expected + ` during "upgrade rep/0"`))
+		},
+		Entry("still open", heldSession{}, "still open at the end"),
+		Entry("failed", heldSession{Err: "exited"}, "failed: exited"),
+		Entry("hung", heldSession{Err: "no output for 10s", Hung: true}, "hung"),
+	)
+})
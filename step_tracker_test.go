@@ -0,0 +1,124 @@
+package dusts_test
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+)
+
+const noStep = "idle"
+
+// upgradeSteps tracks which upgrade step is currently running so that
+// measurements taken concurrently, e.g. by pollers, can be attributed to it.
+// It also keeps the timeline of the steps run by the current spec.
+var upgradeSteps = &stepTracker{current: noStep}
+
+type stepTracker struct {
+	mu       sync.RWMutex
+	current  string
+	steps    []stepRecord
+	versions func() map[string]string
+	initial  map[string]string
+}
+
+// stepRecord is one entry of the step timeline. Versions are the component
+// versions running when the step ended. Fault steps kill components instead
+// of stopping them.
+type stepRecord struct {
+	Name     string            `json:"name"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Versions map[string]string `json:"versions,omitempty"`
+	Fault    bool              `json:"fault,omitempty"`
+}
+
+// Reset clears the timeline. versions, if not nil, is called at the end of
+// every step to record which component versions are running.
+func (t *stepTracker) Reset(versions func() map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current = noStep
+	t.steps = nil
+	t.versions = versions
+	t.initial = nil
+	if versions != nil {
+		t.initial = versions()
+	}
+}
+
+// InitialVersions returns the component versions running when Reset was
+// called.
+func (t *stepTracker) InitialVersions() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.initial
+}
+
+// Begin marks the start of a step, ending the previous one, and reports it
+// with By.
+func (t *stepTracker) Begin(step string) {
+	t.begin(stepRecord{Name: step})
+}
+
+// BeginFault is Begin for a step that injects a fault, whose measurements
+// are held to faultBudget instead.
+func (t *stepTracker) BeginFault(step string) {
+	t.begin(stepRecord{Name: step, Fault: true})
+}
+
+func (t *stepTracker) begin(record stepRecord) {
+	By(record.Name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endCurrent()
+	t.current = record.Name
+	record.Start = time.Now()
+	t.steps = append(t.steps, record)
+}
+
+// Finish ends the current step without starting a new one.
+func (t *stepTracker) Finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endCurrent()
+	t.current = noStep
+}
+
+func (t *stepTracker) endCurrent() {
+	if t.current == noStep || len(t.steps) == 0 {
+		return
+	}
+
+	last := &t.steps[len(t.steps)-1]
+	last.End = time.Now()
+	if t.versions != nil {
+		last.Versions = t.versions()
+	}
+}
+
+func (t *stepTracker) Current() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current
+}
+
+// Faults returns the names of the fault steps of the timeline.
+func (t *stepTracker) Faults() map[string]bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	faults := map[string]bool{}
+	for _, step := range t.steps {
+		if step.Fault {
+			faults[step.Name] = true
+		}
+	}
+	return faults
+}
+
+func (t *stepTracker) Steps() []stepRecord {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]stepRecord{}, t.steps...)
+}
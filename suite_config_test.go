@@ -0,0 +1,124 @@
+package dusts_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("suiteConfig", func() {
+	var savedEnv map[string]*string
+
+	// setEnv sets name for the current spec, or unsets it if value is nil.
+	setEnv := func(name string, value *string) {
+		if _, saved := savedEnv[name]; !saved {
+			if old, ok := os.LookupEnv(name); ok {
+				savedEnv[name] = &old
+			} else {
+				savedEnv[name] = nil
+			}
+		}
+		if value == nil {
+			Expect(os.Unsetenv(name)).To(Succeed())
+		} else {
+			Expect(os.Setenv(name, *value)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		savedEnv = map[string]*string{}
+	})
+
+	AfterEach(func() {
+		for name, value := range savedEnv {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	})
+
+	value := func(s string) *string { return &s }
+
+	DescribeTable("Gopath",
+		func(name string, env, file *string, expected string) {
+			setEnv(name, env)
+			config := defaultSuiteConfig()
+			if file != nil {
+				config.Gopaths[name] = *file
+			}
+			Expect(config.Gopath(name)).To(Equal(expected))
+		},
+		Entry("GOPATH from the file wins over the env", "GOPATH", value("/env"), value("/file"), "/file"),
+		Entry("GOPATH from the env without one in the file", "GOPATH", value("/env"), nil, "/env"),
+		Entry("GOPATH_V0 from the env wins over the file", "GOPATH_V0", value("/env"), value("/file"), "/env"),
+		Entry("GOPATH_V0 from the file without the env", "GOPATH_V0", nil, value("/file"), "/file"),
+		Entry("REP_GOPATH from the file when the env is empty", "REP_GOPATH", value(""), value("/file"), "/file"),
+		Entry("nothing set", "REP_GOPATH_V0", nil, nil, ""),
+	)
+
+	Describe("poller retries", func() {
+		It("defaults to no retries", func() {
+			setEnv("DUSTS_POLLER_RETRIES", nil)
+			config, err := loadSuiteConfig("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Poller.Retries).To(Equal(0))
+		})
+
+		It("is read from the config file and overridden by DUSTS_POLLER_RETRIES", func() {
+			dir, err := ioutil.TempDir("", "dusts-config-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "dusts.yml")
+			Expect(ioutil.WriteFile(path, []byte("poller:\n  retries: 3\n"), 0644)).To(Succeed())
+
+			setEnv("DUSTS_POLLER_RETRIES", nil)
+			config, err := loadSuiteConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Poller.Retries).To(Equal(3))
+
+			setEnv("DUSTS_POLLER_RETRIES", value("10"))
+			config, err = loadSuiteConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Poller.Retries).To(Equal(10))
+		})
+
+		It("rejects a DUSTS_POLLER_RETRIES that is not a number", func() {
+			setEnv("DUSTS_POLLER_RETRIES", value("many"))
+			_, err := loadSuiteConfig("")
+			Expect(err).To(MatchError(ContainSubstring("DUSTS_POLLER_RETRIES: ")))
+		})
+	})
+
+	DescribeTable("FileServerGopathV0",
+		func(env, file, gopathV0 *string, expected string) {
+			setEnv("FILE_SERVER_GOPATH_V0", env)
+			setEnv("GOPATH_V0", gopathV0)
+
+			dir, err := ioutil.TempDir("", "dusts-config-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "dusts.yml")
+			contents := ""
+			if file != nil {
+				contents = "file_server_gopath_v0: " + *file + "\n"
+			}
+			Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+
+			config, err := loadSuiteConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.FileServerGopathV0).To(Equal(expected))
+		},
+		Entry("from the env over the file", value("/env"), value("/file"), value("/diego-release-v0"), "/env"),
+		Entry("from the file without the env", nil, value("/file"), value("/diego-release-v0"), "/file"),
+		Entry("falling back to GOPATH_V0", nil, nil, value("/diego-release-v0"), "/diego-release-v0"),
+		Entry("nothing set", nil, nil, nil, ""),
+	)
+})
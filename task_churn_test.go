@@ -0,0 +1,295 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/inigo/helpers"
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/http_server"
+)
+
+const (
+	taskChurnDomain   = "dusts-task-churn"
+	taskChurnInterval = 500 * time.Millisecond
+	// taskSettleTimeout is how long tasks desired before the churn stopped
+	// may take to call back.
+	taskSettleTimeout = 2 * time.Minute
+)
+
+// churnedTask is what the churn knows about one task guid.
+type churnedTask struct {
+	Guid        string
+	DesiredAt   time.Time
+	DesiredStep string
+	DesireErr   error
+
+	Callbacks     int
+	CompletedAt   time.Time
+	CompletedStep string
+	Failed        bool
+	FailureReason string
+}
+
+// taskChurn keeps desiring short tasks whose completion callbacks go to a
+// local HTTP server, so that every task guid can be reconciled at the end.
+type taskChurn struct {
+	logger      lager.Logger
+	callbackURL string
+	rootFS      string
+
+	mu    sync.Mutex
+	tasks map[string]*churnedTask
+	order []string
+}
+
+func newTaskChurn(logger lager.Logger, callbackAddr, rootFS string) *taskChurn {
+	return &taskChurn{
+		logger:      logger.Session("task-churn"),
+		callbackURL: "http://" + callbackAddr + "/tasks/",
+		rootFS:      rootFS,
+		tasks:       map[string]*churnedTask{},
+	}
+}
+
+// CallbackServer is the stand-in for the Cloud Controller endpoint the BBS
+// calls when a task completes.
+func (c *taskChurn) CallbackServer(addr string) ifrit.Runner {
+	return http_server.New(addr, http.HandlerFunc(c.handleCallback))
+}
+
+func (c *taskChurn) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var response models.TaskCallbackResponse
+	err := json.NewDecoder(r.Body).Decode(&response)
+	if err != nil {
+		c.logger.Error("failed-to-decode-callback", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	guid := strings.TrimPrefix(r.URL.Path, "/tasks/")
+	step := upgradeSteps.Current()
+
+	c.mu.Lock()
+	task, ok := c.tasks[guid]
+	if !ok {
+		task = &churnedTask{Guid: guid}
+		c.tasks[guid] = task
+		c.order = append(c.order, guid)
+	}
+	task.Callbacks++
+	task.CompletedAt = time.Now()
+	task.CompletedStep = step
+	task.Failed = response.Failed
+	task.FailureReason = response.FailureReason
+	c.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Run desires a task every taskChurnInterval until signalled.
+func (c *taskChurn) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(taskChurnInterval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for n := 0; ; n++ {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+			c.desire(fmt.Sprintf("dusts-task-%d-%d", GinkgoParallelNode(), n))
+		}
+	}
+}
+
+func (c *taskChurn) desire(guid string) {
+	task := &churnedTask{Guid: guid, DesiredAt: time.Now(), DesiredStep: upgradeSteps.Current()}
+	c.mu.Lock()
+	c.tasks[guid] = task
+	c.order = append(c.order, guid)
+	c.mu.Unlock()
+
+	definition := &models.TaskDefinition{
+		RootFs:   c.rootFS,
+		MemoryMb: 16,
+		DiskMb:   16,
+		Action: models.WrapAction(&models.RunAction{
+			User: "vcap",
+			Path: "sh",
+			Args: []string{"-c", "sleep 1"},
+		}),
+		CompletionCallbackUrl: c.callbackURL + guid,
+	}
+
+	err := bbsClient.DesireTask(c.logger, guid, taskChurnDomain, definition)
+	if err != nil {
+		c.logger.Info("failed-to-desire-task", lager.Data{"task-guid": guid, "error": err.Error(), "step": task.DesiredStep})
+		c.mu.Lock()
+		task.DesireErr = err
+		c.mu.Unlock()
+	}
+}
+
+// Settle waits until every task that was desired without error has called
+// back, or until taskSettleTimeout.
+func (c *taskChurn) Settle() {
+	deadline := time.Now().Add(taskSettleTimeout)
+	for time.Now().Before(deadline) && c.pending() > 0 {
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *taskChurn) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := 0
+	for _, task := range c.tasks {
+		if task.DesireErr == nil && task.Callbacks == 0 {
+			pending++
+		}
+	}
+	return pending
+}
+
+// taskChurnReport is the reconciliation of every task guid.
+type taskChurnReport struct {
+	Desired            int                 `json:"desired"`
+	DesireErrors       int                 `json:"desire_errors"`
+	Completed          int                 `json:"completed"`
+	Succeeded          int                 `json:"succeeded"`
+	Lost               []string            `json:"lost,omitempty"`
+	Duplicated         []string            `json:"duplicated,omitempty"`
+	Unexpected         []string            `json:"unexpected,omitempty"`
+	FailuresByStep     map[string][]string `json:"failures_by_step,omitempty"`
+	DesireErrorsByStep map[string]int      `json:"desire_errors_by_step,omitempty"`
+}
+
+// Reconcile checks that every task called back exactly once. A task whose
+// desire failed may or may not have been created, so it is only lost if it
+// neither errored nor called back. Lost tasks are described with their state
+// in the BBS.
+func (c *taskChurn) Reconcile() taskChurnReport {
+	report, lost := c.reconcile()
+
+	// The lost tasks are looked up in the BBS without holding c.mu, so that
+	// late callbacks are not blocked on the BBS.
+	for _, task := range lost {
+		report.Lost = append(report.Lost, fmt.Sprintf("%s (desired during %q): %s", task.guid, task.step, describeTask(task.guid)))
+	}
+	return report
+}
+
+// lostTask is a task that was desired without error but never called back.
+type lostTask struct {
+	guid string
+	step string
+}
+
+// reconcile builds the report from the callbacks received so far and
+// returns the lost tasks apart.
+func (c *taskChurn) reconcile() (taskChurnReport, []lostTask) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lost := []lostTask{}
+	report := taskChurnReport{
+		FailuresByStep:     map[string][]string{},
+		DesireErrorsByStep: map[string]int{},
+	}
+
+	for _, guid := range c.order {
+		task := c.tasks[guid]
+		if task.DesiredAt.IsZero() {
+			report.Unexpected = append(report.Unexpected, guid)
+			continue
+		}
+
+		report.Desired++
+		if task.DesireErr != nil {
+			report.DesireErrors++
+			report.DesireErrorsByStep[task.DesiredStep]++
+		}
+
+		switch {
+		case task.Callbacks == 0 && task.DesireErr == nil:
+			lost = append(lost, lostTask{guid: guid, step: task.DesiredStep})
+			continue
+		case task.Callbacks == 0:
+			continue
+		case task.Callbacks > 1:
+			report.Duplicated = append(report.Duplicated, fmt.Sprintf("%s: %d callbacks", guid, task.Callbacks))
+		}
+
+		report.Completed++
+		if task.Failed {
+			report.FailuresByStep[task.CompletedStep] = append(report.FailuresByStep[task.CompletedStep], fmt.Sprintf("%s: %s", guid, task.FailureReason))
+		} else {
+			report.Succeeded++
+		}
+	}
+
+	return report, lost
+}
+
+func describeTask(guid string) string {
+	task, err := bbsClient.TaskByGuid(logger, guid)
+	if err != nil {
+		return fmt.Sprintf("not found in the BBS: %s", err)
+	}
+	return fmt.Sprintf("%s on %q", task.State, task.CellId)
+}
+
+func (r taskChurnReport) String() string {
+	lines := []string{fmt.Sprintf(
+		"%d tasks desired (%d with errors), %d completed, %d succeeded, %d lost, %d completed more than once",
+		r.Desired, r.DesireErrors, r.Completed, r.Succeeded, len(r.Lost), len(r.Duplicated),
+	)}
+
+	steps := []string{}
+	for step := range r.FailuresByStep {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		lines = append(lines, fmt.Sprintf("  %d failed during %q, e.g. %s", len(r.FailuresByStep[step]), step, r.FailuresByStep[step][0]))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Verify fails on lost, duplicated and unexpected tasks. Task failures are
+// only reported, since a rep may fail the tasks it cannot finish before its
+// evacuation timeout.
+func (r taskChurnReport) Verify() error {
+	problems := []string{}
+	for _, lost := range r.Lost {
+		problems = append(problems, "lost "+lost)
+	}
+	for _, duplicated := range r.Duplicated {
+		problems = append(problems, "duplicated "+duplicated)
+	}
+	for _, unexpected := range r.Unexpected {
+		problems = append(problems, "callback for unknown task "+unexpected)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("task churn: %s\n%s", r, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// taskRootFS is the rootfs of the default LRP, which every cell provides.
+func taskRootFS() string {
+	return helpers.DefaultLRPCreateRequest(ComponentMakerV0.Addresses(), "task-rootfs", "task-rootfs", 1).RootFs
+}
@@ -0,0 +1,129 @@
+package dusts_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("taskChurn", func() {
+	var (
+		savedBBSClient bbs.InternalClient
+		fakeBBS        *fake_bbs.FakeInternalClient
+		server         *httptest.Server
+		churn          *taskChurn
+		step           string
+	)
+
+	BeforeEach(func() {
+		savedBBSClient = bbsClient
+		fakeBBS = &fake_bbs.FakeInternalClient{}
+		fakeBBS.DesireTaskStub = func(_ lager.Logger, guid, _ string, _ *models.TaskDefinition) error {
+			if guid == "desire-error" {
+				return errors.New("bbs unavailable")
+			}
+			return nil
+		}
+		fakeBBS.TaskByGuidReturns(&models.Task{State: models.Task_Running, CellId: "cell-1"}, nil)
+		bbsClient = fakeBBS
+
+		server = httptest.NewUnstartedServer(nil)
+		churn = newTaskChurn(lagertest.NewTestLogger("dusts"), server.Listener.Addr().String(), "preloaded:cflinuxfs3")
+		server.Config.Handler = http.HandlerFunc(churn.handleCallback)
+		server.Start()
+
+		step = upgradeSteps.Current()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		bbsClient = savedBBSClient
+	})
+
+	callBack := func(guid string, failed bool, reason string) {
+		body, err := json.Marshal(models.TaskCallbackResponse{TaskGuid: guid, Failed: failed, FailureReason: reason})
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.Post(server.URL+"/tasks/"+guid, "application/json", bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	}
+
+	It("desires tasks calling back to the churn", func() {
+		churn.desire("succeeded")
+
+		Expect(fakeBBS.DesireTaskCallCount()).To(Equal(1))
+		_, guid, domain, definition := fakeBBS.DesireTaskArgsForCall(0)
+		Expect(guid).To(Equal("succeeded"))
+		Expect(domain).To(Equal(taskChurnDomain))
+		Expect(definition.CompletionCallbackUrl).To(Equal(server.URL + "/tasks/succeeded"))
+	})
+
+	It("reconciles every task guid with its callbacks", func() {
+		for _, guid := range []string{"succeeded", "duplicated", "desire-error", "lost"} {
+			churn.desire(guid)
+		}
+		callBack("succeeded", false, "")
+		callBack("duplicated", true, "cell evacuated")
+		callBack("duplicated", true, "cell evacuated")
+		callBack("stray", false, "")
+
+		Expect(churn.pending()).To(Equal(1))
+
+		report := churn.Reconcile()
+		Expect(report.Desired).To(Equal(4))
+		Expect(report.DesireErrors).To(Equal(1))
+		Expect(report.DesireErrorsByStep).To(Equal(map[string]int{step: 1}))
+		Expect(report.Completed).To(Equal(2))
+		Expect(report.Succeeded).To(Equal(1))
+		Expect(report.Duplicated).To(Equal([]string{"duplicated: 2 callbacks"}))
+		Expect(report.Unexpected).To(Equal([]string{"stray"}))
+		Expect(report.FailuresByStep).To(Equal(map[string][]string{step: {"duplicated: cell evacuated"}}))
+
+		Expect(report.Lost).To(HaveLen(1))
+		Expect(report.Lost[0]).To(HavePrefix("lost (desired during "))
+		Expect(report.Lost[0]).To(HaveSuffix(`: Running on "cell-1"`))
+		Expect(fakeBBS.TaskByGuidCallCount()).To(Equal(1))
+		_, guid := fakeBBS.TaskByGuidArgsForCall(0)
+		Expect(guid).To(Equal("lost"))
+
+		err := report.Verify()
+		Expect(err).To(HaveOccurred())
+		problems := strings.Split(err.Error(), "\n")
+		Expect(problems).To(ContainElement(HavePrefix("lost lost ")))
+		Expect(problems).To(ContainElement("duplicated duplicated: 2 callbacks"))
+		Expect(problems).To(ContainElement("callback for unknown task stray"))
+	})
+
+	It("does not count a task whose desire failed as lost", func() {
+		churn.desire("desire-error")
+
+		Expect(churn.pending()).To(BeZero())
+		report := churn.Reconcile()
+		Expect(report.Lost).To(BeEmpty())
+		Expect(report.Verify()).To(Succeed())
+	})
+
+	It("passes when every task called back once, reporting failures", func() {
+		churn.desire("succeeded")
+		churn.desire("failed")
+		callBack("succeeded", false, "")
+		callBack("failed", true, "out of memory")
+
+		report := churn.Reconcile()
+		Expect(report.Verify()).To(Succeed())
+		Expect(report.String()).To(ContainSubstring("2 tasks desired (0 with errors), 2 completed, 1 succeeded, 0 lost, 0 completed more than once"))
+		Expect(report.String()).To(ContainSubstring(`1 failed during "` + step + `", e.g. failed: out of memory`))
+	})
+})
@@ -0,0 +1,162 @@
+package dusts_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/routing-api/fake_routing_api"
+	routingmodels "code.cloudfoundry.org/routing-api/models"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("tcpRouter", func() {
+	var (
+		client *fake_routing_api.FakeClient
+		router *tcpRouter
+		port   uint16
+	)
+
+	mapping := func(externalPort uint16, backend string) routingmodels.TcpRouteMapping {
+		host, portString, err := net.SplitHostPort(backend)
+		Expect(err).NotTo(HaveOccurred())
+		hostPort, err := strconv.Atoi(portString)
+		Expect(err).NotTo(HaveOccurred())
+		return routingmodels.TcpRouteMapping{TcpMappingEntity: routingmodels.TcpMappingEntity{
+			ExternalPort: externalPort,
+			HostIP:       host,
+			HostPort:     uint16(hostPort),
+		}}
+	}
+
+	BeforeEach(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		port = uint16(listener.Addr().(*net.TCPAddr).Port)
+		Expect(listener.Close()).To(Succeed())
+
+		client = &fake_routing_api.FakeClient{}
+		router = newTCPRouter(lagertest.NewTestLogger("dusts"), client, port)
+	})
+
+	Describe("refresh", func() {
+		It("picks the backends of its port round robin", func() {
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{
+				mapping(port, "10.0.0.1:61000"),
+				mapping(port+1, "10.0.0.9:61000"),
+				mapping(port, "10.0.0.2:61001"),
+			}, nil)
+			router.refresh()
+
+			picked := []string{}
+			for i := 0; i < 4; i++ {
+				backend, ok := router.backend()
+				Expect(ok).To(BeTrue())
+				picked = append(picked, backend)
+			}
+			Expect(picked[0]).NotTo(Equal(picked[1]))
+			Expect(picked[:2]).To(ConsistOf("10.0.0.1:61000", "10.0.0.2:61001"))
+			Expect(picked[2:]).To(Equal(picked[:2]))
+		})
+
+		It("replaces the backends with the current mappings", func() {
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{mapping(port, "10.0.0.1:61000")}, nil)
+			router.refresh()
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{mapping(port, "10.0.0.2:61001")}, nil)
+			router.refresh()
+
+			backend, ok := router.backend()
+			Expect(ok).To(BeTrue())
+			Expect(backend).To(Equal("10.0.0.2:61001"))
+		})
+
+		It("keeps the backends when routing-api fails", func() {
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{mapping(port, "10.0.0.1:61000")}, nil)
+			router.refresh()
+			client.TcpRouteMappingsReturns(nil, errors.New("routing-api unavailable"))
+			router.refresh()
+
+			backend, ok := router.backend()
+			Expect(ok).To(BeTrue())
+			Expect(backend).To(Equal("10.0.0.1:61000"))
+		})
+
+		It("has no backend without mappings for its port", func() {
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{mapping(port+1, "10.0.0.1:61000")}, nil)
+			router.refresh()
+
+			_, ok := router.backend()
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("polled by NewTCPPoller", func() {
+		var (
+			backends    []*httptest.Server
+			process     ifrit.Process
+			probeRouter probe
+		)
+
+		BeforeEach(func() {
+			backends = nil
+			for i := 0; i < 2; i++ {
+				backends = append(backends, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				})))
+			}
+
+			process = ifrit.Invoke(router)
+			probeRouter = NewTCPPoller(lagertest.NewTestLogger("dusts"), fmt.Sprintf("127.0.0.1:%d", port)).probe
+		})
+
+		AfterEach(func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive())
+			for _, backend := range backends {
+				backend.Close()
+			}
+		})
+
+		backendAddr := func(server *httptest.Server) string {
+			return strings.TrimPrefix(server.URL, "http://")
+		}
+
+		It("fails while the router has no backend", func() {
+			_, err := probeRouter()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reaches the backends the router picks up from routing-api", func() {
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{
+				mapping(port, backendAddr(backends[0])),
+				mapping(port, backendAddr(backends[1])),
+			}, nil)
+
+			Eventually(func() error {
+				status, err := probeRouter()
+				if err == nil && status != http.StatusOK {
+					err = fmt.Errorf("status %d", status)
+				}
+				return err
+			}).Should(Succeed())
+			Expect(client.TcpRouteMappingsCallCount()).To(BeNumerically(">", 0))
+		})
+
+		It("fails when the picked backend is gone", func() {
+			client.TcpRouteMappingsReturns([]routingmodels.TcpRouteMapping{mapping(port, backendAddr(backends[0]))}, nil)
+			Eventually(func() error { _, err := probeRouter(); return err }).Should(Succeed())
+
+			backends[0].Close()
+			_, err := probeRouter()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,273 @@
+package dusts_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	routeemitterconfig "code.cloudfoundry.org/route-emitter/cmd/route-emitter/config"
+	routing_api "code.cloudfoundry.org/routing-api"
+	routingapi "code.cloudfoundry.org/routing-api/cmd/routing-api/testrunner"
+	routingmodels "code.cloudfoundry.org/routing-api/models"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/grouper"
+	"github.com/tedsuo/ifrit/http_server"
+)
+
+const (
+	tcpRouterGroup = "default-tcp"
+	// tcpRouteRefreshInterval is how often the TCP router stand-in fetches
+	// the TCP route mappings from routing-api.
+	tcpRouteRefreshInterval = 500 * time.Millisecond
+	tcpProbeTimeout         = 5 * time.Second
+)
+
+// tcpRoutes is the TCP routing tier of the running RollingUpgrade spec, nil
+// if the V0 route emitter cannot emit TCP routes. The upgrader enables the
+// TCP emitter of every route emitter while it is set.
+var tcpRoutes *tcpRouting
+
+// tcpRouting is the TCP routing tier of a RollingUpgrade spec: a UAA
+// stand-in issuing tokens to the route emitters, routing-api in dev mode and
+// a TCP router stand-in listening on the single reservable port of the TCP
+// router group.
+type tcpRouting struct {
+	uaaAddr      string
+	routingAPI   *routingapi.RoutingAPIRunner
+	client       routing_api.Client
+	externalPort uint16
+	router       *tcpRouter
+}
+
+// newTCPRouting claims the ports of the UAA stand-in and the TCP router.
+func newTCPRouting(logger lager.Logger) (*tcpRouting, error) {
+	uaaPort, err := allocator.ClaimPorts(1)
+	if err != nil {
+		return nil, err
+	}
+	externalPort, err := allocator.ClaimPorts(1)
+	if err != nil {
+		return nil, err
+	}
+
+	routingAPI := ComponentMakerV1.RoutingAPI(func(cfg *routingapi.Config) {
+		cfg.DevMode = true
+		cfg.RouterGroups = routingmodels.RouterGroups{{
+			Name:            tcpRouterGroup,
+			Type:            routingmodels.RouterGroup_TCP,
+			ReservablePorts: routingmodels.ReservablePorts(fmt.Sprint(externalPort)),
+		}}
+	})
+	client := routingAPI.GetClient()
+
+	return &tcpRouting{
+		uaaAddr:      fmt.Sprintf("127.0.0.1:%d", uaaPort),
+		routingAPI:   routingAPI,
+		client:       client,
+		externalPort: externalPort,
+		router:       newTCPRouter(logger, client, externalPort),
+	}, nil
+}
+
+// Runner starts routing-api only once the UAA stand-in is up, and the TCP
+// router only once routing-api is.
+func (t *tcpRouting) Runner() ifrit.Runner {
+	return grouper.NewOrdered(os.Kill, grouper.Members{
+		{Name: "uaa", Runner: http_server.New(t.uaaAddr, http.HandlerFunc(serveUAAToken))},
+		{Name: "routing-api", Runner: t.routingAPI},
+		{Name: "tcp-router", Runner: t.router},
+	})
+}
+
+// RouterAddr is where the TCP router accepts connections for the canary.
+func (t *tcpRouting) RouterAddr() string {
+	return fmt.Sprintf("127.0.0.1:%d", t.externalPort)
+}
+
+// RouterGroupGUID looks up the guid routing-api gave the TCP router group.
+func (t *tcpRouting) RouterGroupGUID() (string, error) {
+	groups, err := t.client.RouterGroups()
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups {
+		if group.Name == tcpRouterGroup {
+			return group.Guid, nil
+		}
+	}
+	return "", fmt.Errorf("routing-api has no router group %q", tcpRouterGroup)
+}
+
+// enableTCPEmitter makes a route emitter register TCP routes with
+// routing-api, authenticating against the UAA stand-in.
+func (t *tcpRouting) enableTCPEmitter(cfg *routeemitterconfig.RouteEmitterConfig) {
+	cfg.EnableTCPEmitter = true
+	cfg.OAuth = routeemitterconfig.OAuthConfig{
+		UaaURL:         "http://" + t.uaaAddr,
+		ClientName:     "dusts",
+		ClientSecret:   "dusts",
+		SkipCertVerify: true,
+	}
+	cfg.RoutingAPI = routeemitterconfig.RoutingAPIConfig{
+		URL:  "http://127.0.0.1",
+		Port: t.routingAPI.Config.Port,
+	}
+}
+
+// serveUAAToken grants every client a token. routing-api runs in dev mode
+// and does not check it.
+func serveUAAToken(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/oauth/token" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"access_token":"dusts","token_type":"bearer","expires_in":3600,"scope":"routing.routes.write routing.routes.read","jti":"dusts"}`)
+}
+
+// tcpRouter is a stand-in for the CF TCP router: it forwards every
+// connection on its port to one of the backends routing-api has for that
+// port, round robin, refreshing the mappings every tcpRouteRefreshInterval.
+type tcpRouter struct {
+	logger lager.Logger
+	client routing_api.Client
+	port   uint16
+
+	mu       sync.Mutex
+	backends []string
+	next     int
+}
+
+func newTCPRouter(logger lager.Logger, client routing_api.Client, port uint16) *tcpRouter {
+	return &tcpRouter{
+		logger: logger.Session("tcp-router", lager.Data{"port": port}),
+		client: client,
+		port:   port,
+	}
+}
+
+func (r *tcpRouter) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", r.port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.forward(conn)
+		}
+	}()
+
+	ticker := time.NewTicker(tcpRouteRefreshInterval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+			r.refresh()
+		}
+	}
+}
+
+func (r *tcpRouter) refresh() {
+	mappings, err := r.client.TcpRouteMappings()
+	if err != nil {
+		r.logger.Info("failed-to-fetch-tcp-routes", lager.Data{"error": err.Error()})
+		return
+	}
+
+	backends := []string{}
+	for _, mapping := range mappings {
+		if mapping.ExternalPort == r.port {
+			backends = append(backends, fmt.Sprintf("%s:%d", mapping.HostIP, mapping.HostPort))
+		}
+	}
+
+	r.mu.Lock()
+	if strings.Join(backends, ",") != strings.Join(r.backends, ",") {
+		r.logger.Info("backends-changed", lager.Data{"backends": backends})
+	}
+	r.backends = backends
+	r.mu.Unlock()
+}
+
+func (r *tcpRouter) backend() (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.backends) == 0 {
+		return "", false
+	}
+	r.next = (r.next + 1) % len(r.backends)
+	return r.backends[r.next], true
+}
+
+func (r *tcpRouter) forward(conn net.Conn) {
+	defer conn.Close()
+
+	backend, ok := r.backend()
+	if !ok {
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", backend, tcpProbeTimeout)
+	if err != nil {
+		r.logger.Info("failed-to-dial-backend", lager.Data{"backend": backend, "error": err.Error()})
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// NewTCPPoller polls a TCP route by opening a new connection for every
+// request and speaking HTTP to the go-server fixture behind it, so that a
+// connection accepted by the router but not forwarded counts as a failure.
+func NewTCPPoller(logger lager.Logger, routerAddr string) *poller {
+	return &poller{
+		logger: logger,
+		route:  "tcp://" + routerAddr,
+		probe: func() (int, error) {
+			conn, err := net.DialTimeout("tcp", routerAddr, tcpProbeTimeout)
+			if err != nil {
+				return 0, err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(tcpProbeTimeout))
+
+			_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", routerAddr)
+			if err != nil {
+				return 0, err
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				return 0, err
+			}
+			resp.Body.Close()
+			return resp.StatusCode, nil
+		},
+	}
+}
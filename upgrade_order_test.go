@@ -0,0 +1,275 @@
+package dusts_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUpgradeOrders bounds DUSTS_UPGRADE_ORDERS=all, past which a sample has
+// to be asked for instead.
+const maxUpgradeOrders = 1000
+
+// upgradeDependencies is the default dependency graph of plans that do not
+// set their own: a component may only be upgraded after every component it
+// depends on. The BBS goes first since newer clients may call endpoints an
+// older BBS does not serve, and Locket before the BBS that holds its locks
+// there.
+var upgradeDependencies = map[string][]string{
+	componentBBS:               {componentLocket},
+	componentAuctioneer:        {componentBBS},
+	componentRep:               {componentBBS},
+	componentRouteEmitter:      {componentBBS},
+	componentLocalRouteEmitter: {componentBBS},
+	componentSSHProxy:          {componentBBS},
+}
+
+// upgradeOrder is one order of the batches of the first upgrade plan, run by
+// a RollingUpgrade spec of its own.
+type upgradeOrder struct {
+	Index int
+	Total int
+	// Seed is the DUSTS_UPGRADE_ORDER_SEED the order was sampled with, 0 when
+	// every order is run.
+	Seed    int64
+	Batches []string
+	Plan    *UpgradePlan
+}
+
+// Name identifies the order in spec names, e.g. "order 3 of 10 (seed 42)".
+func (o upgradeOrder) Name() string {
+	name := fmt.Sprintf("order %d of %d", o.Index, o.Total)
+	if o.Seed != 0 {
+		name += fmt.Sprintf(" (seed %d)", o.Seed)
+	}
+	return name
+}
+
+func (o upgradeOrder) String() string {
+	return strings.Join(o.Batches, " → ")
+}
+
+// upgradeOrders are the orders the RollingUpgrade specs run the first plan
+// in besides its own, resolved at package initialization since the spec tree
+// depends on them. BeforeSuite fails on upgradeOrdersErr.
+var upgradeOrderSeed = pickUpgradeOrderSeed()
+var upgradeOrders, upgradeOrdersErr = generateUpgradeOrders(suite.UpgradeOrders, upgradeOrderSeed)
+
+func pickUpgradeOrderSeed() int64 {
+	if suite.UpgradeOrderSeed != 0 {
+		return suite.UpgradeOrderSeed
+	}
+	return time.Now().UnixNano()
+}
+
+func generateUpgradeOrders(mode string, seed int64) ([]upgradeOrder, error) {
+	if mode == "" || v0Release == nil {
+		return nil, nil
+	}
+
+	planPath := v0Release.UpgradePlan
+	if suite.UpgradePlan != "" {
+		planPath = suite.UpgradePlan
+	}
+	plan, err := LoadUpgradePlan(planPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cells, batchSize := plan.CellCount(), plan.BatchSize()
+	graph := plan.batchGraph(cells, batchSize)
+
+	var orders [][]int
+	if mode == "all" {
+		orders, err = allTopologicalOrders(graph, maxUpgradeOrders)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s, sample them by setting a number instead", plan.Name, err)
+		}
+		seed = 0
+	} else {
+		n, err := strconv.Atoi(mode)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is neither \"all\" nor a number of orders", mode)
+		}
+		orders = sampleTopologicalOrders(graph, n, rand.New(rand.NewSource(seed)))
+	}
+
+	batches := plan.Batches(cells, batchSize)
+	result := []upgradeOrder{}
+	for i, order := range orders {
+		descriptions := []string{}
+		for _, b := range order {
+			descriptions = append(descriptions, batchDescription(batches[b]))
+		}
+		result = append(result, upgradeOrder{
+			Index:   i + 1,
+			Total:   len(orders),
+			Seed:    seed,
+			Batches: descriptions,
+			Plan:    plan.Reordered(cells, batchSize, order),
+		})
+	}
+	return result, nil
+}
+
+func batchDescription(batch planBatch) string {
+	if batch.Description != "" {
+		return batch.Description
+	}
+	names := []string{}
+	for _, step := range batch.Steps {
+		names = append(names, fmt.Sprintf("%s %s", step.Action, instanceName(step.Component, step.Index)))
+	}
+	return strings.Join(names, ", ")
+}
+
+// Reordered returns a copy of the plan that runs its batches, as expanded
+// for the given cells and batch size, in the given order. Every batch becomes
+// an instance group of its own so that it still runs as one.
+func (p *UpgradePlan) Reordered(cells, batchSize int, order []int) *UpgradePlan {
+	reordered := *p
+	reordered.Cells = cells
+	reordered.MaxInFlight = batchSize
+	reordered.Steps = []PlanStep{}
+
+	batches := p.Batches(cells, batchSize)
+	for _, b := range order {
+		for i, step := range batches[b].Steps {
+			step.InstanceGroup = fmt.Sprintf("batch-%d", b)
+			step.Description = ""
+			if i == 0 {
+				step.Description = batches[b].Description
+			}
+			reordered.Steps = append(reordered.Steps, step)
+		}
+	}
+	return &reordered
+}
+
+// batchGraph returns, for every batch of the plan, the earlier batches it
+// has to run after: the ones changing an instance it changes too, and the
+// ones changing a component it depends on or that depends on it, so the
+// plan's own order of dependent batches is kept.
+func (p *UpgradePlan) batchGraph(cells, batchSize int) [][]int {
+	dependencies := p.Dependencies
+	if dependencies == nil {
+		dependencies = upgradeDependencies
+	}
+	dependsOn := func(a, b string) bool {
+		for _, dependency := range dependencies[a] {
+			if dependency == b {
+				return true
+			}
+		}
+		return false
+	}
+
+	batches := p.Batches(cells, batchSize)
+	graph := make([][]int, len(batches))
+	for j := range batches {
+		for i := 0; i < j; i++ {
+			related := false
+			for _, later := range batches[j].Steps {
+				for _, earlier := range batches[i].Steps {
+					if later.Component == earlier.Component && later.Index == earlier.Index ||
+						dependsOn(later.Component, earlier.Component) ||
+						dependsOn(earlier.Component, later.Component) {
+						related = true
+					}
+				}
+			}
+			if related {
+				graph[j] = append(graph[j], i)
+			}
+		}
+	}
+	return graph
+}
+
+// allTopologicalOrders enumerates every order of the graph's nodes in which
+// each node comes after the nodes it points to, failing once there are more
+// than limit.
+func allTopologicalOrders(graph [][]int, limit int) ([][]int, error) {
+	orders := [][]int{}
+	placed := make([]bool, len(graph))
+	order := []int{}
+
+	var visit func() error
+	visit = func() error {
+		if len(order) == len(graph) {
+			if len(orders) == limit {
+				return fmt.Errorf("more than %d orders", limit)
+			}
+			orders = append(orders, append([]int{}, order...))
+			return nil
+		}
+		for _, node := range available(graph, placed) {
+			placed[node] = true
+			order = append(order, node)
+			err := visit()
+			order = order[:len(order)-1]
+			placed[node] = false
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := visit()
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, errors.New("the dependencies are cyclic")
+	}
+	return orders, nil
+}
+
+// sampleTopologicalOrders draws up to n distinct orders by repeatedly placing
+// a random node whose dependencies are placed, giving up on finding more
+// after 20 draws per order.
+func sampleTopologicalOrders(graph [][]int, n int, random *rand.Rand) [][]int {
+	orders := [][]int{}
+	seen := map[string]bool{}
+
+	for attempt := 0; attempt < 20*n && len(orders) < n; attempt++ {
+		placed := make([]bool, len(graph))
+		order := []int{}
+		for len(order) < len(graph) {
+			candidates := available(graph, placed)
+			node := candidates[random.Intn(len(candidates))]
+			placed[node] = true
+			order = append(order, node)
+		}
+
+		key := fmt.Sprint(order)
+		if !seen[key] {
+			seen[key] = true
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+func available(graph [][]int, placed []bool) []int {
+	nodes := []int{}
+	for node, dependencies := range graph {
+		if placed[node] {
+			continue
+		}
+		ready := true
+		for _, dependency := range dependencies {
+			if !placed[dependency] {
+				ready = false
+			}
+		}
+		if ready {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
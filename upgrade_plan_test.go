@@ -0,0 +1,445 @@
+package dusts_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	auctioneerconfig "code.cloudfoundry.org/auctioneer/cmd/auctioneer/config"
+	bbsconfig "code.cloudfoundry.org/bbs/cmd/bbs/config"
+	sshproxyconfig "code.cloudfoundry.org/diego-ssh/cmd/ssh-proxy/config"
+	locketconfig "code.cloudfoundry.org/locket/cmd/locket/config"
+	repconfig "code.cloudfoundry.org/rep/cmd/rep/config"
+	routeemitterconfig "code.cloudfoundry.org/route-emitter/cmd/route-emitter/config"
+)
+
+const (
+	componentLocket            = "locket"
+	componentBBS               = "bbs"
+	componentAuctioneer        = "auctioneer"
+	componentRouteEmitter      = "route-emitter"
+	componentLocalRouteEmitter = "local-route-emitter"
+	componentRep               = "rep"
+	componentSSHProxy          = "ssh-proxy"
+	componentFileServer        = "file-server"
+)
+
+const (
+	actionUpgrade   = "upgrade"
+	actionDowngrade = "downgrade"
+	actionRestart   = "restart"
+	actionEvacuate  = "evacuate"
+	actionKill      = "kill"
+)
+
+var planComponents = map[string]bool{
+	componentLocket:            true,
+	componentBBS:               true,
+	componentAuctioneer:        true,
+	componentRouteEmitter:      true,
+	componentLocalRouteEmitter: true,
+	componentRep:               true,
+	componentSSHProxy:          true,
+	componentFileServer:        true,
+}
+
+// defaultCells is the number of cells of plans that do not set it.
+const defaultCells = 2
+
+// UpgradePlan describes the V0 topology a rolling upgrade starts from and the
+// ordered steps that move it to V1. Plans are interpreted by planUpgrader.
+//
+// Per-cell processes and steps are expanded for every cell. Cells and
+// MaxInFlight are defaults that the suite configuration can override.
+//
+// Dependencies maps a component to the components that have to be upgraded
+// before it, and decides which other orders of the steps DUSTS_UPGRADE_ORDERS
+// may run. Plans that do not set it get upgradeDependencies.
+type UpgradePlan struct {
+	Name         string              `json:"name"`
+	Cells        int                 `json:"cells,omitempty"`
+	MaxInFlight  int                 `json:"max_in_flight,omitempty"`
+	Dependencies map[string][]string `json:"dependencies,omitempty"`
+	StartUp      []PlanProcess       `json:"start_up"`
+	Steps        []PlanStep          `json:"steps"`
+}
+
+// PlanProcess is a single V0 component instance started by StartUp, or one
+// per cell if PerCell is set.
+type PlanProcess struct {
+	Component string   `json:"component"`
+	Index     int      `json:"index,omitempty"`
+	PerCell   bool     `json:"per_cell,omitempty"`
+	Mutators  []string `json:"mutators,omitempty"`
+}
+
+// PlanStep is one transition of a running component instance. Evacuate only
+// applies to reps: the cell is evacuated and replaced by the next version.
+// Kill sends SIGKILL to the instance, without evacuating reps, and replaces
+// it by the next version once the cluster converges again. A kill step of
+// the BBS with KillDuring "migration" also kills its replacement while it
+// migrates the database before starting it again.
+//
+// A per-cell step applies to the instance of every cell. {cells} in its
+// description is replaced by the cells of the batch it runs in.
+//
+// Consecutive steps with the same InstanceGroup run as one batch, like the
+// jobs BOSH stops and starts together on a VM. The batch is described by the
+// first of them.
+type PlanStep struct {
+	Action        string   `json:"action"`
+	Component     string   `json:"component"`
+	Index         int      `json:"index,omitempty"`
+	PerCell       bool     `json:"per_cell,omitempty"`
+	InstanceGroup string   `json:"instance_group,omitempty"`
+	Mutators      []string `json:"mutators,omitempty"`
+	KillDuring    string   `json:"kill_during,omitempty"`
+	Description   string   `json:"description,omitempty"`
+}
+
+// planBatch is a set of steps with the same action on different instances
+// that are run together, like the instances BOSH updates at once with
+// max_in_flight.
+type planBatch struct {
+	Description string
+	Steps       []PlanStep
+}
+
+func instanceName(component string, index int) string {
+	return fmt.Sprintf("%s/%d", component, index)
+}
+
+func LoadUpgradePlan(path string) (*UpgradePlan, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &UpgradePlan{}
+	err = json.Unmarshal(contents, plan)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upgrade plan %s: %s", path, err)
+	}
+
+	err = plan.Validate(plan.CellCount())
+	if err != nil {
+		return nil, fmt.Errorf("invalid upgrade plan %s: %s", path, err)
+	}
+
+	return plan, nil
+}
+
+// CellCount is the number of cells the plan starts, unless overridden by the
+// suite configuration.
+func (p *UpgradePlan) CellCount() int {
+	if suite.Cells > 0 {
+		return suite.Cells
+	}
+	if p.Cells > 0 {
+		return p.Cells
+	}
+	return defaultCells
+}
+
+// BatchSize is how many cells per-cell steps are applied to at once.
+func (p *UpgradePlan) BatchSize() int {
+	if suite.MaxInFlight > 0 {
+		return suite.MaxInFlight
+	}
+	if p.MaxInFlight > 0 {
+		return p.MaxInFlight
+	}
+	return 1
+}
+
+// Starts reports whether the plan starts an instance of the component.
+func (p *UpgradePlan) Starts(component string) bool {
+	for _, process := range p.StartUp {
+		if process.Component == component {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs reports whether the plan starts or upgrades an instance of the
+// component.
+func (p *UpgradePlan) Runs(component string) bool {
+	if p.Starts(component) {
+		return true
+	}
+	for _, step := range p.Steps {
+		if step.Component == component {
+			return true
+		}
+	}
+	return false
+}
+
+// Processes returns the instances started by the plan with the per-cell
+// processes expanded for the given number of cells.
+func (p *UpgradePlan) Processes(cells int) []PlanProcess {
+	processes := []PlanProcess{}
+	for _, process := range p.StartUp {
+		if !process.PerCell {
+			processes = append(processes, process)
+			continue
+		}
+		for cell := 0; cell < cells; cell++ {
+			expanded := process
+			expanded.Index = cell
+			expanded.PerCell = false
+			processes = append(processes, expanded)
+		}
+	}
+	return processes
+}
+
+// Batches returns the steps of the plan in the order they run. Every step
+// that is not per-cell is a batch of its own, or of its instance group's.
+// Consecutive per-cell steps are
+// applied to batchSize cells at a time: every step of the run to the first
+// cells, then every step to the next cells, and so on.
+func (p *UpgradePlan) Batches(cells, batchSize int) []planBatch {
+	batches := []planBatch{}
+
+	for i := 0; i < len(p.Steps); {
+		if !p.Steps[i].PerCell {
+			step := p.Steps[i]
+			batch := planBatch{Description: step.Description, Steps: []PlanStep{step}}
+			i++
+			for step.InstanceGroup != "" && i < len(p.Steps) && !p.Steps[i].PerCell && p.Steps[i].InstanceGroup == step.InstanceGroup {
+				batch.Steps = append(batch.Steps, p.Steps[i])
+				i++
+			}
+			batches = append(batches, batch)
+			continue
+		}
+
+		end := i
+		for end < len(p.Steps) && p.Steps[end].PerCell {
+			end++
+		}
+
+		for first := 0; first < cells; first += batchSize {
+			last := first + batchSize
+			if last > cells {
+				last = cells
+			}
+
+			for _, step := range p.Steps[i:end] {
+				batch := planBatch{}
+				if step.Description != "" {
+					batch.Description = strings.Replace(step.Description, "{cells}", cellList(first, last), -1)
+				}
+				for cell := first; cell < last; cell++ {
+					expanded := step
+					expanded.Index = cell
+					expanded.PerCell = false
+					batch.Steps = append(batch.Steps, expanded)
+				}
+				batches = append(batches, batch)
+			}
+		}
+
+		i = end
+	}
+
+	return batches
+}
+
+func cellList(first, last int) string {
+	if last-first == 1 {
+		return fmt.Sprintf("cell %d", first)
+	}
+	cells := []string{}
+	for cell := first; cell < last; cell++ {
+		cells = append(cells, strconv.Itoa(cell))
+	}
+	return "cells " + strings.Join(cells, ", ")
+}
+
+func (p *UpgradePlan) Validate(cells int) error {
+	processes := p.Processes(cells)
+	if len(processes) == 0 {
+		return errors.New("no processes to start up")
+	}
+
+	for component, dependencies := range p.Dependencies {
+		for _, dependency := range append([]string{component}, dependencies...) {
+			if !planComponents[dependency] {
+				return fmt.Errorf("dependencies: unknown component %q", dependency)
+			}
+		}
+	}
+
+	started := map[string]bool{}
+	for _, process := range processes {
+		name := instanceName(process.Component, process.Index)
+		if !planComponents[process.Component] {
+			return fmt.Errorf("unknown component %q", process.Component)
+		}
+		if started[name] {
+			return fmt.Errorf("%s is started more than once", name)
+		}
+		started[name] = true
+
+		_, err := resolveMutators(process.Component, process.Mutators)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Errors refer to steps by their index in Steps, before per-cell steps
+	// are expanded and instance groups batched.
+	for i, step := range p.Steps {
+		instances := []PlanStep{step}
+		if step.PerCell {
+			instances = nil
+			for cell := 0; cell < cells; cell++ {
+				expanded := step
+				expanded.Index = cell
+				instances = append(instances, expanded)
+			}
+		}
+		for _, instance := range instances {
+			name := instanceName(instance.Component, instance.Index)
+			if !started[name] {
+				return fmt.Errorf("step %d: %s is never started", i, name)
+			}
+		}
+
+		if i > 0 && !step.PerCell && step.InstanceGroup != "" {
+			previous := p.Steps[i-1]
+			if !previous.PerCell && previous.InstanceGroup == step.InstanceGroup && previous.Action != step.Action {
+				return fmt.Errorf("step %d: instance group %s mixes %s and %s", i, step.InstanceGroup, previous.Action, step.Action)
+			}
+		}
+
+		switch step.Action {
+		case actionUpgrade, actionDowngrade, actionRestart, actionKill:
+		case actionEvacuate:
+			if step.Component != componentRep {
+				return fmt.Errorf("step %d: cannot evacuate %s", i, step.Component)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown action %q", i, step.Action)
+		}
+
+		if step.KillDuring != "" {
+			if step.KillDuring != killDuringMigration {
+				return fmt.Errorf("step %d: unknown kill_during %q", i, step.KillDuring)
+			}
+			if step.Action != actionKill || step.Component != componentBBS {
+				return fmt.Errorf("step %d: only kill steps of the BBS can kill during a migration", i)
+			}
+		}
+
+		_, err := resolveMutators(step.Component, step.Mutators)
+		if err != nil {
+			return fmt.Errorf("step %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateUpgradeChain validates the plan of every hop of a multi-hop
+// upgrade. The StartUp of a later hop is the topology it upgrades: its
+// instances that an earlier hop started keep running as they are, and the
+// others are started when the hop begins.
+func validateUpgradeChain(hops []*UpgradePlan, cells int) error {
+	if len(hops) == 0 {
+		return errors.New("no upgrade plans")
+	}
+
+	for _, plan := range hops {
+		err := plan.Validate(cells)
+		if err != nil {
+			return fmt.Errorf("%s: %s", plan.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// planMutators are the config mutators plans can refer to by name. Each
+// mutator is a func modifying the config of exactly one component type.
+var planMutators = map[string]interface{}{
+	"skip-locket-for-bbs": func(cfg *bbsconfig.BBSConfig) {
+		cfg.LocksLocketEnabled = false
+		cfg.CellRegistrationsLocketEnabled = false
+	},
+	"fallback-to-http-auctioneer": func(cfg *bbsconfig.BBSConfig) {
+		cfg.AuctioneerRequireTLS = false
+	},
+	"disable-auctioneer-ssl": func(cfg *auctioneerconfig.AuctioneerConfig) {
+		cfg.CACertFile = ""
+		cfg.ServerCertFile = ""
+		cfg.ServerKeyFile = ""
+	},
+	"disable-locket-for-auctioneer": func(cfg *auctioneerconfig.AuctioneerConfig) {
+		cfg.LocksLocketEnabled = false
+	},
+	"export-network-configs": func(cfg *repconfig.RepConfig) {
+		cfg.ExportNetworkEnvVars = true
+	},
+	"short-evacuation-timeout": func(cfg *repconfig.RepConfig) {
+		cfg.EvacuationTimeout = suite.EvacuationTimeout
+	},
+	"diego-ssh-auth": func(cfg *sshproxyconfig.SSHProxyConfig) {
+		cfg.EnableDiegoAuth = true
+		cfg.DiegoCredentials = sshCredentials
+	},
+}
+
+type configMutators struct {
+	locket       []func(*locketconfig.LocketConfig)
+	bbs          []func(*bbsconfig.BBSConfig)
+	auctioneer   []func(*auctioneerconfig.AuctioneerConfig)
+	rep          []func(*repconfig.RepConfig)
+	routeEmitter []func(*routeemitterconfig.RouteEmitterConfig)
+	sshProxy     []func(*sshproxyconfig.SSHProxyConfig)
+}
+
+func resolveMutators(component string, names []string) (configMutators, error) {
+	mutators := configMutators{}
+
+	for _, name := range names {
+		mutator, ok := planMutators[name]
+		if !ok {
+			return mutators, fmt.Errorf("unknown mutator %q", name)
+		}
+
+		applies := false
+		switch f := mutator.(type) {
+		case func(*locketconfig.LocketConfig):
+			applies = component == componentLocket
+			mutators.locket = append(mutators.locket, f)
+		case func(*bbsconfig.BBSConfig):
+			applies = component == componentBBS
+			mutators.bbs = append(mutators.bbs, f)
+		case func(*auctioneerconfig.AuctioneerConfig):
+			applies = component == componentAuctioneer
+			mutators.auctioneer = append(mutators.auctioneer, f)
+		case func(*repconfig.RepConfig):
+			applies = component == componentRep
+			mutators.rep = append(mutators.rep, f)
+		case func(*routeemitterconfig.RouteEmitterConfig):
+			applies = component == componentRouteEmitter || component == componentLocalRouteEmitter
+			mutators.routeEmitter = append(mutators.routeEmitter, f)
+		case func(*sshproxyconfig.SSHProxyConfig):
+			applies = component == componentSSHProxy
+			mutators.sshProxy = append(mutators.sshProxy, f)
+		}
+
+		if !applies {
+			return mutators, fmt.Errorf("mutator %q does not apply to %s", name, component)
+		}
+	}
+
+	return mutators, nil
+}
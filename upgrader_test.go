@@ -2,15 +2,14 @@ package dusts_test
 
 import (
 	"fmt"
-	"net"
-	"net/http"
-	"strconv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
-	auctioneerconfig "code.cloudfoundry.org/auctioneer/cmd/auctioneer/config"
-	bbsconfig "code.cloudfoundry.org/bbs/cmd/bbs/config"
-	"code.cloudfoundry.org/durationjson"
 	"code.cloudfoundry.org/inigo/helpers"
+	"code.cloudfoundry.org/inigo/world"
 	repconfig "code.cloudfoundry.org/rep/cmd/rep/config"
 	routeemitterconfig "code.cloudfoundry.org/route-emitter/cmd/route-emitter/config"
 
@@ -20,170 +19,428 @@ import (
 	"github.com/tedsuo/ifrit/ginkgomon"
 )
 
-func upgradeRep(idx int, process *ifrit.Process, modifyFuncs ...func(*repconfig.RepConfig)) {
-	msg := fmt.Sprintf("Upgrading cell %d", idx)
-	By(msg)
+type Upgrader interface {
+	StartUp()
+	RollingUpgrade()
+	// Rollback reverts every step applied so far, newest first, returning all
+	// components to the version and config they were started with.
+	Rollback()
+	// Reorder replaces the first upgrade plan with one that starts the same
+	// processes, e.g. the same plan with its steps in another order.
+	Reorder(plan *UpgradePlan)
+	ShutDown()
+}
 
-	host, portStr, _ := net.SplitHostPort(ComponentMakerV0.Addresses().Rep)
-	port, err := strconv.Atoi(portStr)
-	ExpectWithOffset(1, err).NotTo(HaveOccurred())
-	port = port + 10*idx // TODO: this is a hack based on offsetPort in components.go
+type planProcess struct {
+	PlanProcess
+	process    ifrit.Process
+	generation int
+	mutators   []string
+}
 
-	By(fmt.Sprintf("evacuating cell%d", idx))
-	addr := fmt.Sprintf("http://%s:%d/evacuate", host, port)
-	_, err = http.Post(addr, "", nil)
-	ExpectWithOffset(1, err).NotTo(HaveOccurred())
-	EventuallyWithOffset(1, (*process).Wait()).Should(Receive())
+// appliedStep records the state of an instance before a step changed it so
+// that Rollback can restore it. Instances started by a later hop are stopped
+// again instead.
+type appliedStep struct {
+	name       string
+	generation int
+	mutators   []string
+	evacuate   bool
+	started    bool
+}
 
-	*process = ginkgomon.Invoke(ComponentMakerV1.RepN(idx, modifyFuncs...))
+// planUpgrader is an Upgrader driven by one UpgradePlan per upgrade hop.
+// Every component instance starts at generation 0 (ComponentMakerV0) as
+// described by the first plan; upgrade and downgrade steps move it one
+// generation up or down, towards ComponentMakerV1 as the last generation.
+// Instances in the StartUp of a later hop that are not running yet, e.g.
+// Locket when upgrading from a GA release, are started at the generation
+// the hop upgrades from when it begins. The first plan also decides the
+// number of cells for every hop.
+type planUpgrader struct {
+	hops      []*UpgradePlan
+	cells     int
+	processes map[string]*planProcess
+	order     []string
+	reps      map[int]repInstance
+	applied   []appliedStep
+
+	// makeRunner and start are the ComponentMakers and startComponent,
+	// replaced with fakes to test the upgrader itself.
+	makeRunner func(p *planProcess, generation int, mutators []string) ifrit.Runner
+	start      func(ifrit.Runner) ifrit.Process
 }
 
-type Upgrader interface {
-	StartUp()
-	RollingUpgrade()
-	ShutDown()
+func NewPlanUpgrader(hops ...*UpgradePlan) Upgrader {
+	cells := defaultCells
+	if len(hops) > 0 {
+		cells = hops[0].CellCount()
+	}
+
+	u := &planUpgrader{
+		hops:      hops,
+		cells:     cells,
+		processes: map[string]*planProcess{},
+		reps:      map[int]repInstance{},
+		start:     startComponent,
+	}
+	u.makeRunner = u.runner
+	return u
 }
 
-type diegoGAUpgrader struct {
-	bbs          ifrit.Process
-	routeEmitter ifrit.Process
-	auctioneer   ifrit.Process
-	rep0         ifrit.Process
-	rep1         ifrit.Process
+func componentMakers() []world.ComponentMaker {
+	makers := []world.ComponentMaker{ComponentMakerV0}
+	makers = append(makers, IntermediateComponentMakers...)
+	return append(makers, ComponentMakerV1)
 }
 
-func NewGAUpgrader() Upgrader {
-	return &diegoGAUpgrader{}
+func (u *planUpgrader) StartUp() {
+	Expect(validateUpgradeChain(u.hops, u.cells)).To(Succeed())
+	Expect(u.hops).To(HaveLen(len(componentMakers())-1), "expected one upgrade plan per hop")
+
+	for _, process := range u.hops[0].Processes(u.cells) {
+		name := instanceName(process.Component, process.Index)
+		p := &planProcess{PlanProcess: process, mutators: process.Mutators}
+		p.process = u.invoke(p, 0, process.Mutators, u.start)
+		u.processes[name] = p
+		u.order = append(u.order, name)
+	}
+
+	upgradeSteps.Reset(u.Versions)
 }
 
-func (ga *diegoGAUpgrader) StartUp() {
-	ga.bbs = ginkgomon.Invoke(ComponentMakerV0.BBS())
-	ga.routeEmitter = ginkgomon.Invoke(ComponentMakerV0.RouteEmitter())
-	ga.auctioneer = ginkgomon.Invoke(ComponentMakerV0.Auctioneer())
-	ga.rep0 = ginkgomon.Invoke(ComponentMakerV0.RepN(0))
-	ga.rep1 = ginkgomon.Invoke(ComponentMakerV0.RepN(1))
+// Versions returns the version each component instance is running.
+func (u *planUpgrader) Versions() map[string]string {
+	versions := map[string]string{}
+	for name, p := range u.processes {
+		versions[name] = generationName(p.generation)
+	}
+	return versions
 }
 
-func (ga *diegoGAUpgrader) RollingUpgrade() {
-	By("Upgrading the BBS")
-	ginkgomon.Interrupt(ga.bbs, 5*time.Second)
-	skipLocket := func(cfg *bbsconfig.BBSConfig) {
-		cfg.LocksLocketEnabled = false
-		cfg.CellRegistrationsLocketEnabled = false
+// generationName is the diego-release version of a ComponentMaker generation,
+// with the last generation being built from source.
+func generationName(generation int) string {
+	switch {
+	case generation == 0:
+		return v0Release.Version
+	case generation <= len(intermediateReleases):
+		return intermediateReleases[generation-1].Version
 	}
-	ga.bbs = ginkgomon.Invoke(ComponentMakerV1.BBS(skipLocket))
+	return "development"
+}
 
-	By("Upgrading the Auctioneer")
-	ginkgomon.Interrupt(ga.auctioneer, 5*time.Second)
-	ga.auctioneer = ginkgomon.Invoke(ComponentMakerV1.Auctioneer(func(cfg *auctioneerconfig.AuctioneerConfig) {
-		cfg.LocksLocketEnabled = false
-	}))
+func (u *planUpgrader) RollingUpgrade() {
+	for hop, plan := range u.hops {
+		if len(u.hops) > 1 {
+			By(fmt.Sprintf("Upgrading from V%d to V%d using %s", hop, hop+1, plan.Name))
+		}
+		if hop > 0 {
+			u.startNew(plan, hop)
+		}
+
+		for _, batch := range plan.Batches(u.cells, plan.BatchSize()) {
+			u.runBatch(batch)
+		}
+	}
+	upgradeSteps.Finish()
+}
 
-	By("Upgrading the Route Emitter")
-	ginkgomon.Interrupt(ga.routeEmitter, 5*time.Second)
-	ga.routeEmitter = ginkgomon.Invoke(ComponentMakerV1.RouteEmitter())
+// startNew starts every instance of the plan's StartUp that is not running
+// yet at the given generation, in the order they are listed.
+func (u *planUpgrader) startNew(plan *UpgradePlan, generation int) {
+	processes := []PlanProcess{}
+	names := []string{}
+	for _, process := range plan.Processes(u.cells) {
+		name := instanceName(process.Component, process.Index)
+		if _, ok := u.processes[name]; !ok {
+			processes = append(processes, process)
+			names = append(names, name)
+		}
+	}
+	if len(processes) == 0 {
+		return
+	}
 
-	upgradeRep(0, &ga.rep0)
+	upgradeSteps.Begin(fmt.Sprintf("Starting %s at V%d", strings.Join(names, ", "), generation))
+	for i, process := range processes {
+		p := &planProcess{PlanProcess: process, generation: generation, mutators: process.Mutators}
+		p.process = u.invoke(p, generation, process.Mutators, u.start)
+		u.processes[names[i]] = p
+		u.order = append(u.order, names[i])
+		u.applied = append(u.applied, appliedStep{name: names[i], started: true})
+	}
+}
 
-	upgradeRep(1, &ga.rep1)
+func (u *planUpgrader) Reorder(plan *UpgradePlan) {
+	hops := append([]*UpgradePlan{plan}, u.hops[1:]...)
+	Expect(validateUpgradeChain(hops, u.cells)).To(Succeed())
+	u.hops = hops
 }
 
-func (ga *diegoGAUpgrader) ShutDown() {
-	helpers.StopProcesses(
-		ga.routeEmitter,
-		ga.auctioneer,
-		ga.rep0,
-		ga.rep1,
-		ga.bbs,
-	)
+func (u *planUpgrader) ShutDown() {
+	processes := []ifrit.Process{}
+	for i := len(u.order) - 1; i >= 0; i-- {
+		processes = append(processes, u.processes[u.order[i]].process)
+	}
+	helpers.StopProcesses(processes...)
 }
 
-type diegoLocketLocalREUpgrader struct {
-	bbs              ifrit.Process
-	routeEmitter0    ifrit.Process
-	routeEmitter1    ifrit.Process
-	auctioneer       ifrit.Process
-	rep0             ifrit.Process
-	rep1             ifrit.Process
-	locket           ifrit.Process
-	cell0ID, cell1ID string
+// runBatch stops every instance of the batch before starting any of them at
+// its new generation, so that the whole batch is down at the same time.
+func (u *planUpgrader) runBatch(batch planBatch) {
+	processes := []*planProcess{}
+	generations := []int{}
+	names := []string{}
+
+	for _, step := range batch.Steps {
+		name := instanceName(step.Component, step.Index)
+		p := u.processes[name]
+
+		generation := p.generation
+		switch step.Action {
+		case actionUpgrade, actionEvacuate, actionKill:
+			generation++
+		case actionDowngrade:
+			generation--
+		}
+		Expect(generation).To(BeNumerically(">=", 0), "cannot downgrade %s below V0", name)
+		Expect(generation).To(BeNumerically("<", len(componentMakers())), "cannot upgrade %s past V%d", name, len(componentMakers())-1)
+
+		processes = append(processes, p)
+		generations = append(generations, generation)
+		names = append(names, name)
+	}
+
+	action := batch.Steps[0].Action
+	description := batch.Description
+	if description == "" {
+		description = fmt.Sprintf("%s %s from V%d to V%d", stepVerb(action), strings.Join(names, ", "), processes[0].generation, generations[0])
+	}
+	if action == actionKill {
+		upgradeSteps.BeginFault(description)
+	} else {
+		upgradeSteps.Begin(description)
+	}
+
+	for i, p := range processes {
+		u.applied = append(u.applied, appliedStep{
+			name:       names[i],
+			generation: p.generation,
+			mutators:   p.mutators,
+			evacuate:   action == actionEvacuate,
+		})
+	}
+
+	if action == actionKill {
+		u.kill(processes)
+	} else {
+		u.stop(processes, action == actionEvacuate)
+	}
+	for i, p := range processes {
+		step := batch.Steps[i]
+		if step.KillDuring == killDuringMigration {
+			u.invoke(p, generations[i], step.Mutators, killOnMigration(names[i]))
+		}
+		p.process = u.invoke(p, generations[i], step.Mutators, u.start)
+		p.generation = generations[i]
+		p.mutators = step.Mutators
+	}
+
+	if action == actionKill {
+		u.waitForConvergence()
+	}
+}
+
+func (u *planUpgrader) Rollback() {
+	for i := len(u.applied) - 1; i >= 0; i-- {
+		step := u.applied[i]
+		p := u.processes[step.name]
+
+		if step.started {
+			upgradeSteps.Begin(fmt.Sprintf("Rolling back %s by stopping it", step.name))
+			u.stop([]*planProcess{p}, false)
+			u.remove(step.name)
+			continue
+		}
+
+		upgradeSteps.Begin(fmt.Sprintf("Rolling back %s from V%d to V%d", step.name, p.generation, step.generation))
+		u.stop([]*planProcess{p}, step.evacuate)
+		p.process = u.invoke(p, step.generation, step.mutators, func(runner ifrit.Runner) ifrit.Process {
+			return invokeOrFail(runner, "%s refused to start at V%d after running at V%d", step.name, step.generation, p.generation)
+		})
+		p.generation = step.generation
+		p.mutators = step.mutators
+	}
+	u.applied = nil
+	upgradeSteps.Finish()
+}
+
+// remove forgets a stopped instance.
+func (u *planUpgrader) remove(name string) {
+	delete(u.processes, name)
+	for i, n := range u.order {
+		if n == name {
+			u.order = append(u.order[:i], u.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// invoke starts the instance at the given generation with its output going
+// to its own component log file.
+func (u *planUpgrader) invoke(p *planProcess, generation int, mutators []string, start func(ifrit.Runner) ifrit.Process) ifrit.Process {
+	return componentLogFiles.Invoke(p.Component, p.Index, generation, u.makeRunner(p, generation, mutators), start)
+}
+
+// stop signals every process, or asks every rep to evacuate, before waiting
+// for any of them to exit.
+func (u *planUpgrader) stop(processes []*planProcess, evacuate bool) {
+	if evacuate {
+		cellIDs := []string{}
+		for _, p := range processes {
+			cellIDs = append(cellIDs, u.reps[p.Index].CellID)
+		}
+		watcher, err := watchEvacuation(cellIDs)
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+		cells := []evacuatingCell{}
+		for _, p := range processes {
+			rep := u.reps[p.Index]
+			By(fmt.Sprintf("evacuating %s", rep.CellID))
+			ExpectWithOffset(1, startEvacuation(rep)).To(Succeed())
+			cells = append(cells, evacuatingCell{
+				repInstance: rep,
+				Name:        instanceName(p.Component, p.Index),
+				Process:     p.process,
+			})
+		}
+		ExpectWithOffset(1, waitForEvacuation(cells)).To(Succeed())
+		ExpectWithOffset(1, watcher.Stop()).To(Succeed())
+		return
+	}
+
+	for _, p := range processes {
+		p.process.Signal(os.Interrupt)
+	}
+	for _, p := range processes {
+		EventuallyWithOffset(1, p.process.Wait(), 5*time.Second).Should(Receive())
+	}
 }
 
-func NewLocketLocalREUpgrader() *diegoLocketLocalREUpgrader {
-	return &diegoLocketLocalREUpgrader{}
+// fileServerAssets holds the files every file server serves next to the
+// lifecycles of its release, e.g. lrp.zip.
+var fileServerAssets string
+
+func copyAssets(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, contents, info.Mode())
+	})
 }
 
-func (lre *diegoLocketLocalREUpgrader) StartUp() {
-	lre.locket = ginkgomon.Invoke(ComponentMakerV0.Locket())
+// startComponent is ginkgomon.Invoke, failing through recordFailure so that
+// the upgrade report has the failure and the step it happened in.
+func startComponent(runner ifrit.Runner) ifrit.Process {
+	return invokeOrFail(runner, "process failed to start")
+}
 
-	lre.bbs = ginkgomon.Invoke(ComponentMakerV0.BBS())
-	lre.auctioneer = ginkgomon.Invoke(ComponentMakerV0.Auctioneer())
+// invokeOrFail is ginkgomon.Invoke with a failure message that explains what
+// it means for the process not to start, e.g. a V0 BBS refusing to run
+// against a database migrated by V1. A process that neither becomes ready
+// nor exits within startTimeout is killed.
+func invokeOrFail(runner ifrit.Runner, format string, args ...interface{}) ifrit.Process {
+	process := ifrit.Background(runner)
+	select {
+	case <-process.Ready():
+	case err := <-process.Wait():
+		recordFailure(fmt.Sprintf("%s: %v", fmt.Sprintf(format, args...), err), 1)
+	case <-time.After(startTimeout(runner)):
+		process.Signal(os.Kill)
+		recordFailure(fmt.Sprintf("%s: not ready after %s", fmt.Sprintf(format, args...), startTimeout(runner)), 1)
+	}
+	return process
+}
 
-	lre.rep0 = ginkgomon.Invoke(ComponentMakerV0.RepN(0, func(cfg *repconfig.RepConfig) {
-		cfg.EvacuationTimeout = durationjson.Duration(10 * time.Second)
-		lre.cell0ID = cfg.CellID
-	}))
-	lre.rep1 = ginkgomon.Invoke(ComponentMakerV0.RepN(1, func(cfg *repconfig.RepConfig) {
-		cfg.EvacuationTimeout = durationjson.Duration(10 * time.Second)
-		lre.cell1ID = cfg.CellID
-	}))
+// startTimeout is the StartCheckTimeout of ginkgomon runners, which
+// ginkgomon defaults to 5s, plus the time it takes to start the executable.
+func startTimeout(runner ifrit.Runner) time.Duration {
+	timeout := 5 * time.Second
+	if r, ok := runner.(*loggedRunner); ok {
+		runner = r.runner
+	}
+	if r, ok := runner.(*ginkgomon.Runner); ok && r.StartCheckTimeout > 0 {
+		timeout = r.StartCheckTimeout
+	}
+	return timeout + 5*time.Second
+}
 
-	lre.routeEmitter0 = ginkgomon.Invoke(ComponentMakerV0.RouteEmitterN(0, func(cfg *routeemitterconfig.RouteEmitterConfig) {
-		cfg.CellID = lre.cell0ID
-	}))
-	lre.routeEmitter1 = ginkgomon.Invoke(ComponentMakerV0.RouteEmitterN(1, func(cfg *routeemitterconfig.RouteEmitterConfig) {
-		cfg.CellID = lre.cell1ID
-	}))
+func stepVerb(action string) string {
+	switch action {
+	case actionUpgrade:
+		return "Upgrading"
+	case actionDowngrade:
+		return "Downgrading"
+	case actionRestart:
+		return "Restarting"
+	case actionEvacuate:
+		return "Evacuating and upgrading"
+	case actionKill:
+		return "Killing and upgrading"
+	}
+	return action
 }
 
-func (lre *diegoLocketLocalREUpgrader) ShutDown() {
-	helpers.StopProcesses(
-		lre.routeEmitter0,
-		lre.routeEmitter1,
-		lre.auctioneer,
-		lre.rep0,
-		lre.rep1,
-		lre.bbs,
-		lre.locket,
-	)
-}
+func (u *planUpgrader) runner(p *planProcess, generation int, mutatorNames []string) ifrit.Runner {
+	mutators, err := resolveMutators(p.Component, mutatorNames)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	maker := componentMakers()[generation]
+	if tcpRoutes != nil {
+		mutators.routeEmitter = append(mutators.routeEmitter, tcpRoutes.enableTCPEmitter)
+	}
+
+	switch p.Component {
+	case componentLocket:
+		return maker.Locket(mutators.locket...)
+	case componentBBS:
+		return maker.BBS(mutators.bbs...)
+	case componentAuctioneer:
+		return maker.Auctioneer(mutators.auctioneer...)
+	case componentRouteEmitter:
+		return maker.RouteEmitter(mutators.routeEmitter...)
+	case componentLocalRouteEmitter:
+		setCellID := func(cfg *routeemitterconfig.RouteEmitterConfig) {
+			cfg.CellID = u.reps[p.Index].CellID
+		}
+		return maker.RouteEmitterN(p.Index, append(mutators.routeEmitter, setCellID)...)
+	case componentRep:
+		recordRep := func(cfg *repconfig.RepConfig) {
+			u.reps[p.Index] = newRepInstance(cfg)
+		}
+		return maker.RepN(p.Index, append(mutators.rep, recordRep)...)
+	case componentSSHProxy:
+		return maker.SSHProxy(mutators.sshProxy...)
+	case componentFileServer:
+		fileServer, assetsDir := maker.FileServer()
+		ExpectWithOffset(1, copyAssets(fileServerAssets, assetsDir)).To(Succeed())
+		return fileServer
+	}
 
-func (lre *diegoLocketLocalREUpgrader) RollingUpgrade() {
-	By("Upgrading Locket")
-	ginkgomon.Interrupt(lre.locket, 5*time.Second)
-	lre.locket = ginkgomon.Invoke(ComponentMakerV1.Locket())
-
-	By("Downgrading Locket")
-	ginkgomon.Interrupt(lre.locket, 5*time.Second)
-	lre.locket = ginkgomon.Invoke(ComponentMakerV0.Locket())
-
-	By("Upgrading the BBS")
-	ginkgomon.Interrupt(lre.bbs, 5*time.Second)
-	lre.bbs = ginkgomon.Invoke(ComponentMakerV1.BBS())
-
-	By("Upgrading Locket")
-	ginkgomon.Interrupt(lre.locket, 5*time.Second)
-	lre.locket = ginkgomon.Invoke(ComponentMakerV1.Locket())
-
-	By("Upgrading the Auctioneer")
-	ginkgomon.Interrupt(lre.auctioneer, 5*time.Second)
-	lre.auctioneer = ginkgomon.Invoke(ComponentMakerV1.Auctioneer())
-
-	setEvacuationTimeout := func(cfg *repconfig.RepConfig) {
-		cfg.EvacuationTimeout = durationjson.Duration(10 * time.Second)
-	}
-
-	upgradeRep(0, &lre.rep0, setEvacuationTimeout)
-	By("Upgrading Route Emitter 0")
-	ginkgomon.Interrupt(lre.routeEmitter0, 5*time.Second)
-	lre.routeEmitter0 = ginkgomon.Invoke(ComponentMakerV1.RouteEmitterN(0, func(cfg *routeemitterconfig.RouteEmitterConfig) {
-		cfg.CellID = lre.cell0ID
-	}))
-
-	upgradeRep(1, &lre.rep1, setEvacuationTimeout)
-	By("Upgrading Route Emitter 1")
-	ginkgomon.Interrupt(lre.routeEmitter1, 5*time.Second)
-	lre.routeEmitter1 = ginkgomon.Invoke(ComponentMakerV1.RouteEmitterN(1, func(cfg *routeemitterconfig.RouteEmitterConfig) {
-		cfg.CellID = lre.cell1ID
-	}))
+	recordFailure(fmt.Sprintf("unknown component %q", p.Component))
+	return nil
 }
@@ -0,0 +1,399 @@
+package dusts_test
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/inigo/helpers/certauthority"
+	"code.cloudfoundry.org/inigo/helpers/portauthority"
+	"code.cloudfoundry.org/inigo/world"
+)
+
+type componentMakerFactory func(world.BuiltArtifacts, world.ComponentAddresses, portauthority.PortAllocator, certauthority.CertAuthority) world.ComponentMaker
+
+// releaseCapabilities describes what a range of diego-release versions looks
+// like when used as V0. MinVersion is inclusive, MaxVersion is exclusive and
+// may be empty for no upper bound.
+type releaseCapabilities struct {
+	Name       string
+	MinVersion string
+	MaxVersion string
+
+	Components         []string
+	MakeComponentMaker componentMakerFactory
+	UpgradePlan        string
+	// ScenarioPlans start the same processes as UpgradePlan and are run by
+	// RollingUpgrade specs of their own, for upgrade paths that BOSH would
+	// not take.
+	ScenarioPlans []string
+	// EmitsTCPRoutes is whether the route emitter of the release can
+	// register TCP routes with routing-api. Older releases ship a separate
+	// tcp-emitter job, which the suite does not start.
+	EmitsTCPRoutes bool
+
+	// VizziniStages are the UpgradeVizzini specs of the release, from V0
+	// towards V1 one set of components at a time.
+	VizziniStages []vizziniStage
+
+	// UnsupportedVizziniTests are skipped when running the V0 vizzini suite.
+	UnsupportedVizziniTests []string
+	// UnsupportedVizziniTestsWithV0Rep are skipped when running the V1 vizzini
+	// suite against a V0 rep.
+	UnsupportedVizziniTestsWithV0Rep []string
+}
+
+// vizziniStage is one UpgradeVizzini spec. The Upgraded components run at
+// V1 and the other Components of the release at V0, except for the file
+// server, which is plumbing. Mutators names the planMutators of each
+// component, whichever version of it runs.
+type vizziniStage struct {
+	Name        string
+	Upgraded    []string
+	V1BBSClient bool
+	Mutators    map[string][]string
+}
+
+func (s vizziniStage) Upgrades(component string) bool {
+	for _, c := range s.Upgraded {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+type diegoRelease struct {
+	Version string
+	releaseCapabilities
+}
+
+func (r *diegoRelease) HasComponent(component string) bool {
+	for _, c := range r.Components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *diegoRelease) HasLocket() bool {
+	return r.HasComponent(componentLocket)
+}
+
+// Validate checks the plans the release is upgraded with and its vizzini
+// stages against the components of the release.
+func (r *diegoRelease) Validate(planPaths ...string) error {
+	for _, path := range planPaths {
+		plan, err := LoadUpgradePlan(path)
+		if err != nil {
+			return err
+		}
+		err = r.ValidatePlan(plan)
+		if err != nil {
+			return err
+		}
+	}
+	return r.ValidateVizziniStages()
+}
+
+// ValidatePlan checks that plan only starts components of the release.
+func (r *diegoRelease) ValidatePlan(plan *UpgradePlan) error {
+	for _, process := range plan.StartUp {
+		if !r.HasComponent(process.Component) {
+			return fmt.Errorf("%s: diego-release %s has no %s", plan.Name, r.Version, process.Component)
+		}
+	}
+	return nil
+}
+
+// ValidateVizziniStages checks that the stages only upgrade and mutate
+// components of the release.
+func (r *diegoRelease) ValidateVizziniStages() error {
+	for _, stage := range r.VizziniStages {
+		for _, component := range stage.Upgraded {
+			if !r.HasComponent(component) {
+				return fmt.Errorf("vizzini stage %q: diego-release %s has no %s", stage.Name, r.Version, component)
+			}
+		}
+		for component, names := range stage.Mutators {
+			if !r.HasComponent(component) {
+				return fmt.Errorf("vizzini stage %q: diego-release %s has no %s", stage.Name, r.Version, component)
+			}
+			_, err := resolveMutators(component, names)
+			if err != nil {
+				return fmt.Errorf("vizzini stage %q: %s", stage.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	repV0UnsupportedVizziniTests = []string{"MaxPids", "CF_INSTANCE_INTERNAL_IP", "sidecar"}
+	// security_group_tests in V0 vizzini won't pass since they try to access the
+	// router (as opposed to www.example.com in recent versions). Security groups
+	// don't affect access to the host machine, therefore they cannot block
+	// traffic which causes both tests in that file to fail
+	securityGroupV0Tests = "should allow access to an internal IP"
+)
+
+// gaVizziniStages upgrade a release without locket, whose BBS and
+// auctioneer have to keep holding their locks in consul once upgraded.
+var gaVizziniStages = []vizziniStage{
+	{Name: "v0 configuration"},
+	{
+		Name:     "upgrading the BBS API",
+		Upgraded: []string{componentBBS, componentSSHProxy},
+		Mutators: map[string][]string{
+			componentBBS:        {"skip-locket-for-bbs", "fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-auctioneer-ssl"},
+		},
+	},
+	{
+		Name:        "upgrading the BBS API and BBS client",
+		Upgraded:    []string{componentBBS, componentSSHProxy},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"skip-locket-for-bbs", "fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-auctioneer-ssl"},
+		},
+	},
+	{
+		Name:        "upgrading the BBS API, BBS client, sshProxy, and Auctioneer",
+		Upgraded:    []string{componentBBS, componentSSHProxy, componentAuctioneer},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"skip-locket-for-bbs", "fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-locket-for-auctioneer", "disable-auctioneer-ssl"},
+		},
+	},
+	{
+		Name:        "upgrading the BBS API, BBS client, sshProxy, Auctioneer, and Rep",
+		Upgraded:    []string{componentBBS, componentSSHProxy, componentAuctioneer, componentRep},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"skip-locket-for-bbs", "fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-locket-for-auctioneer", "disable-auctioneer-ssl"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+	{
+		Name:        "upgrading the BBS API, BBS client, sshProxy, Auctioneer, Rep, and Route Emitter",
+		Upgraded:    []string{componentBBS, componentSSHProxy, componentAuctioneer, componentRep, componentRouteEmitter},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"skip-locket-for-bbs", "fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-locket-for-auctioneer"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+}
+
+// locketVizziniStages upgrade a release with locket and a route emitter on
+// every cell.
+var locketVizziniStages = []vizziniStage{
+	{
+		Name:     "v0 configuration",
+		Mutators: map[string][]string{componentRep: {"export-network-configs"}},
+	},
+	{
+		Name:     "upgrading the Locket API",
+		Upgraded: []string{componentLocket},
+		Mutators: map[string][]string{componentRep: {"export-network-configs"}},
+	},
+	{
+		Name:     "upgrading the BBS API",
+		Upgraded: []string{componentBBS},
+		Mutators: map[string][]string{
+			componentBBS:        {"fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-auctioneer-ssl"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+	{
+		Name:     "upgrading the Locket and BBS API",
+		Upgraded: []string{componentLocket, componentBBS},
+		Mutators: map[string][]string{
+			componentBBS:        {"fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-auctioneer-ssl"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+	{
+		Name:        "upgrading the Locket, BBS API and BBS client",
+		Upgraded:    []string{componentLocket, componentBBS},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-auctioneer-ssl"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+	{
+		Name:        "upgrading the Locket, BBS API, BBS client, sshProxy, and Auctioneer",
+		Upgraded:    []string{componentLocket, componentBBS, componentSSHProxy, componentAuctioneer},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-locket-for-auctioneer"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+	{
+		Name:        "upgrading the Locket, BBS API, BBS client, sshProxy, Auctioneer, and Rep",
+		Upgraded:    []string{componentLocket, componentBBS, componentSSHProxy, componentAuctioneer, componentRep, componentLocalRouteEmitter},
+		V1BBSClient: true,
+		Mutators: map[string][]string{
+			componentBBS:        {"fallback-to-http-auctioneer"},
+			componentAuctioneer: {"disable-locket-for-auctioneer"},
+			componentRep:        {"export-network-configs"},
+		},
+	},
+}
+
+var releaseRegistry = []releaseCapabilities{
+	{
+		Name:       "diego-ga",
+		MinVersion: "v1.0.0",
+		MaxVersion: "v1.25.0",
+		Components: []string{
+			componentBBS,
+			componentAuctioneer,
+			componentRep,
+			componentRouteEmitter,
+			componentSSHProxy,
+			componentFileServer,
+		},
+		MakeComponentMaker:               world.MakeV0ComponentMaker,
+		UpgradePlan:                      "plans/diego-ga.json",
+		VizziniStages:                    gaVizziniStages,
+		UnsupportedVizziniTests:          []string{securityGroupV0Tests},
+		UnsupportedVizziniTestsWithV0Rep: repV0UnsupportedVizziniTests,
+	},
+	{
+		Name:       "diego-locket-local-re",
+		MinVersion: "v1.25.0",
+		Components: []string{
+			componentLocket,
+			componentBBS,
+			componentAuctioneer,
+			componentRep,
+			componentLocalRouteEmitter,
+			componentSSHProxy,
+			componentFileServer,
+		},
+		MakeComponentMaker: world.MakeComponentMaker,
+		UpgradePlan:        "plans/diego-locket-local-re.json",
+		ScenarioPlans: []string{
+			"plans/diego-locket-local-re-locket-downgrade.json",
+		},
+		EmitsTCPRoutes:                   true,
+		VizziniStages:                    locketVizziniStages,
+		UnsupportedVizziniTests:          []string{securityGroupV0Tests},
+		UnsupportedVizziniTestsWithV0Rep: repV0UnsupportedVizziniTests,
+	},
+}
+
+// v0Release is resolved at package initialization since the UpgradeVizzini
+// spec tree depends on it. BeforeSuite fails on v0ReleaseErr.
+var v0Release, v0ReleaseErr = lookupRelease(suite.DiegoVersionV0)
+
+// scenarioPlans are the ScenarioPlans of the V0 release, unless
+// DUSTS_UPGRADE_PLAN replaces the plan whose processes they start.
+func scenarioPlans() []string {
+	if v0Release == nil || suite.UpgradePlan != "" {
+		return nil
+	}
+	return v0Release.ScenarioPlans
+}
+
+func lookupRelease(version string) (*diegoRelease, error) {
+	if version == "" {
+		return nil, errors.New("DIEGO_VERSION_V0 not set")
+	}
+
+	v, err := parseReleaseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, capabilities := range releaseRegistry {
+		min, err := parseReleaseVersion(capabilities.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		if v.less(min) {
+			continue
+		}
+
+		if capabilities.MaxVersion != "" {
+			max, err := parseReleaseVersion(capabilities.MaxVersion)
+			if err != nil {
+				return nil, err
+			}
+			if !v.less(max) {
+				continue
+			}
+		}
+
+		return &diegoRelease{Version: version, releaseCapabilities: capabilities}, nil
+	}
+
+	return nil, fmt.Errorf("no release capabilities registered for diego-release %s", version)
+}
+
+// lookupIntermediateReleases resolves a comma separated list of releases to
+// upgrade through between V0 and V1.
+func lookupIntermediateReleases(versions string) ([]*diegoRelease, error) {
+	releases := []*diegoRelease{}
+	if versions == "" {
+		return releases, nil
+	}
+
+	for _, version := range strings.Split(versions, ",") {
+		release, err := lookupRelease(strings.TrimSpace(version))
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+
+	return releases, nil
+}
+
+type releaseVersion [3]int
+
+func parseReleaseVersion(version string) (releaseVersion, error) {
+	var v releaseVersion
+
+	trimmed := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+
+	parts := strings.Split(trimmed, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("invalid diego-release version %q", version)
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, fmt.Errorf("invalid diego-release version %q", version)
+		}
+		v[i] = n
+	}
+
+	return v, nil
+}
+
+func (v releaseVersion) less(other releaseVersion) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}